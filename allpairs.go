@@ -0,0 +1,164 @@
+package simstore
+
+// iterate returns a function yielding the signatures of u in order
+func (u u64slice) iterate() func() (uint64, bool) {
+	var i int
+	return func() (uint64, bool) {
+		if i >= len(u) {
+			return 0, false
+		}
+		i++
+		return u[i-1], true
+	}
+}
+
+// iterate returns a function yielding the signatures of z in order,
+// decompressing one block at a time
+func (z *zstore) iterate() func() (uint64, bool) {
+	var block int
+	var u u64slice
+	return func() (uint64, bool) {
+		for len(u) == 0 {
+			if block >= z.blocks() {
+				return 0, false
+			}
+			u = z.block(block)
+			block++
+		}
+		p := u[0]
+		u = u[1:]
+		return p, true
+	}
+}
+
+// mergeIterators yields the signatures of all the sorted iterators in order
+func mergeIterators(its []func() (uint64, bool)) func() (uint64, bool) {
+	heads := make([]uint64, len(its))
+	for i, it := range its {
+		var ok bool
+		if heads[i], ok = it(); !ok {
+			its[i] = nil
+		}
+	}
+
+	return func() (uint64, bool) {
+		lo := -1
+		for i, it := range its {
+			if it != nil && (lo == -1 || heads[i] < heads[lo]) {
+				lo = i
+			}
+		}
+		if lo == -1 {
+			return 0, false
+		}
+		p := heads[lo]
+		var ok bool
+		if heads[lo], ok = its[lo](); !ok {
+			its[lo] = nil
+		}
+		return p, true
+	}
+}
+
+// iterateTable yields the signatures of permuted table t and its pending
+// inserts in order
+func (s *Store) iterateTable(t int) func() (uint64, bool) {
+	var its []func() (uint64, bool)
+	if s.rhashes[t] != nil {
+		its = append(its, s.rhashes[t].iterate())
+	}
+	if s.merging != nil {
+		its = append(its, s.merging.rhashes[t].iterate())
+	}
+	if s.delta != nil {
+		its = append(its, s.delta.rhashes[t].iterate())
+	}
+	return mergeIterators(its)
+}
+
+// AllPairs calls fn once for each pair of documents in the store within the
+// store's distance k of each other.  Each permuted table is walked once, and
+// signatures sharing a table's prefix are compared; a pair is reported only
+// by the first table in which it shares a prefix.  fn must not modify the
+// store.
+func (s *Store) AllPairs(fn func(a, b Match)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// empty store
+	if s.empty() {
+		return
+	}
+
+	var group []uint64
+
+	for t, p := range s.perms {
+		next := s.iterateTable(t)
+
+		group = group[:0]
+		for {
+			h, ok := next()
+			if ok && len(group) > 0 && h == group[len(group)-1] {
+				// duplicate signature
+				continue
+			}
+			if !ok || len(group) > 0 && h&p.mask != group[0]&p.mask {
+				s.pairGroup(t, group, fn)
+				group = group[:0]
+			}
+			if !ok {
+				break
+			}
+			group = append(group, h)
+		}
+	}
+}
+
+// pairGroup reports the pairs within distance k among the distinct permuted
+// signatures in group, which all share the prefix of table t
+func (s *Store) pairGroup(t int, group []uint64, fn func(a, b Match)) {
+	p := s.perms[t]
+
+	for i := range group {
+		x := p.unshuffle(group[i])
+
+		// documents sharing a signature are reported once, from the
+		// first table
+		if t == 0 {
+			docs := s.findDoc(x)
+			for a := range docs {
+				for b := a + 1; b < len(docs); b++ {
+					fn(Match{DocID: docs[a], Sig: x}, Match{DocID: docs[b], Sig: x})
+				}
+			}
+		}
+
+		for j := i + 1; j < len(group); j++ {
+			d := distance(group[i], group[j])
+			if d > s.k {
+				continue
+			}
+
+			y := p.unshuffle(group[j])
+			if s.pairedBefore(t, x, y) {
+				continue
+			}
+
+			for _, a := range s.findDoc(x) {
+				for _, b := range s.findDoc(y) {
+					fn(Match{DocID: a, Sig: x, Distance: d}, Match{DocID: b, Sig: y, Distance: d})
+				}
+			}
+		}
+	}
+}
+
+// pairedBefore reports whether x and y share the prefix of a table before t
+func (s *Store) pairedBefore(t int, x, y uint64) bool {
+	for _, p := range s.perms[:t] {
+		if (p.shuffle(x)^p.shuffle(y))&p.mask == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package simstore
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type pair struct{ a, b uint64 }
+
+func TestAllPairs(t *testing.T) {
+
+	const signatures = 5000
+
+	tests := []struct {
+		name string
+		s    interface {
+			removeStorage
+			AllPairs(fn func(a, b Match))
+		}
+		k int
+	}{
+		{"store3", New3(signatures, NewU64Slice), 3},
+		{"store3z", New3(signatures, NewZStore), 3},
+		{"store6", New6(signatures, NewU64Slice), 6},
+		{"storeK", NewK(2, signatures, NewZStore), 2},
+	}
+
+	for _, tt := range tests {
+		rng := rand.New(rand.NewSource(0))
+
+		// clusters of near-duplicates
+		var sigs []uint64
+		for len(sigs) < signatures {
+			sig := uint64(rng.Int63())
+			for n := rng.Intn(5); n >= 0; n-- {
+				v := sig
+				for i := rng.Intn(tt.k + 3); i > 0; i-- {
+					v ^= 1 << uint(rng.Intn(64))
+				}
+				sigs = append(sigs, v)
+			}
+		}
+
+		// documents sharing a signature
+		sigs = append(sigs, sigs[0], sigs[0])
+
+		for i, sig := range sigs[:signatures/2] {
+			tt.s.Add(sig, uint64(i))
+		}
+		tt.s.Finish()
+		for i, sig := range sigs[signatures/2:] {
+			tt.s.Add(sig, uint64(signatures/2+i))
+		}
+		tt.s.RemoveDocID(1)
+
+		want := make(map[pair]int)
+		for i := range sigs {
+			for j := i + 1; j < len(sigs); j++ {
+				if i != 1 && j != 1 && distance(sigs[i], sigs[j]) <= tt.k {
+					want[pair{uint64(i), uint64(j)}] = distance(sigs[i], sigs[j])
+				}
+			}
+		}
+
+		got := make(map[pair]int)
+		tt.s.AllPairs(func(a, b Match) {
+			if a.DocID > b.DocID {
+				a, b = b, a
+			}
+			p := pair{a.DocID, b.DocID}
+			if _, ok := got[p]; ok {
+				t.Errorf("%s: pair %v reported twice", tt.name, p)
+			}
+			if a.Sig != sigs[a.DocID] || b.Sig != sigs[b.DocID] {
+				t.Errorf("%s: pair %v has signatures %016x,%016x", tt.name, p, a.Sig, b.Sig)
+			}
+			got[p] = a.Distance
+		})
+
+		if len(want) == 0 {
+			t.Fatalf("%s: no pairs to find", tt.name)
+		}
+
+		for p, d := range want {
+			if g, ok := got[p]; !ok || g != d {
+				t.Errorf("%s: pair %v distance=%d,%v, want %d", tt.name, p, g, ok, d)
+			}
+		}
+
+		for p := range got {
+			if _, ok := want[p]; !ok {
+				t.Errorf("%s: unexpected pair %v", tt.name, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package simstore
+
+import "sort"
+
+// batch is a set of queries sorted by their permuted signature
+type batch struct {
+	sigs []uint64
+	idx  []int
+}
+
+func (b batch) Len() int           { return len(b.sigs) }
+func (b batch) Less(i, j int) bool { return b.sigs[i] < b.sigs[j] }
+func (b batch) Swap(i, j int) {
+	b.sigs[i], b.sigs[j] = b.sigs[j], b.sigs[i]
+	b.idx[i], b.idx[j] = b.idx[j], b.idx[i]
+}
+
+// FindBatch is like calling Find for each of sigs.  The queries are sorted
+// for each permutation so each table is walked once rather than searched
+// from scratch for every query.
+func (s *Store) FindBatch(sigs []uint64) [][]uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([][]uint64, len(sigs))
+
+	// empty store
+	if s.empty() {
+		return results
+	}
+
+	b := batch{sigs: make([]uint64, len(sigs)), idx: make([]int, len(sigs))}
+
+	for t, p := range s.perms {
+		for i, sig := range sigs {
+			b.sigs[i] = p.shuffle(sig)
+			b.idx[i] = i
+		}
+		sort.Sort(b)
+
+		found := func(i int, h uint64) {
+			q := b.idx[i]
+			results[q] = append(results[q], p.unshuffle(h))
+		}
+
+		if s.rhashes[t] != nil {
+			s.rhashes[t].findSorted(b.sigs, p.mask, s.k, found)
+		}
+		if s.merging != nil {
+			s.merging.rhashes[t].findSorted(b.sigs, p.mask, s.k, found)
+		}
+		if s.delta != nil {
+			s.delta.rhashes[t].findSorted(b.sigs, p.mask, s.k, found)
+		}
+	}
+
+	for i, r := range results {
+		results[i] = s.docidsFor(unique(r))
+	}
+
+	return results
+}
+
+// FindBatch is like calling Find for each of sigs.
+func (s *SmallStore3) FindBatch(sigs []uint64) [][]uint64 {
+	results := make([][]uint64, len(sigs))
+	for i, sig := range sigs {
+		results[i] = s.Find(sig)
+	}
+	return results
+}
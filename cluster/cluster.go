@@ -0,0 +1,151 @@
+// Package cluster groups the near-duplicate documents of a simstore.
+/*
+Pairs of documents within the store's hamming distance k are found with the
+store's AllPairs self-join and then grouped either transitively, as the
+connected components of the near-duplicate graph, or around leaders, so that
+every document is within k of its cluster's leader.
+*/
+package cluster
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dgryski/go-simstore"
+)
+
+// Pairer is implemented by simstore.Store and Store6
+type Pairer interface {
+	AllPairs(fn func(a, b simstore.Match))
+}
+
+// Mode selects how near-duplicate pairs are grouped into clusters
+type Mode int
+
+const (
+	// Transitive clusters are connected components: documents are in the
+	// same cluster if there is a chain of near-duplicates between them.
+	Transitive Mode = iota
+
+	// Leader clusters are built by visiting documents in docid order.  A
+	// document joins the cluster of the first leader it is within k of,
+	// or else becomes a leader itself.  A leader whose near-duplicates all
+	// joined earlier leaders is left in a cluster of its own.
+	Leader
+)
+
+// Cluster groups the documents of the finished store s.  It returns a map
+// from cluster id to the sorted document ids in the cluster.  The cluster id
+// is the smallest document id in a transitive cluster, or the leader's
+// document id.  Every document with a near-duplicate is in exactly one
+// cluster; documents without any near-duplicates are not included.
+func Cluster(s Pairer, mode Mode) (map[uint64][]uint64, error) {
+	switch mode {
+	case Transitive:
+		return components(s), nil
+	case Leader:
+		return leaders(s), nil
+	default:
+		return nil, fmt.Errorf("cluster: unknown mode %d", mode)
+	}
+}
+
+// unionFind is a disjoint-set forest over document ids
+type unionFind map[uint64]uint64
+
+func (u unionFind) find(x uint64) uint64 {
+	root := x
+	for {
+		p, ok := u[root]
+		if !ok {
+			u[root] = root
+			break
+		}
+		if p == root {
+			break
+		}
+		root = p
+	}
+
+	// path compression
+	for x != root {
+		x, u[x] = u[x], root
+	}
+
+	return root
+}
+
+// union joins the sets of x and y, keeping the smaller id as the root
+func (u unionFind) union(x, y uint64) {
+	x, y = u.find(x), u.find(y)
+	if x == y {
+		return
+	}
+	if y < x {
+		x, y = y, x
+	}
+	u[y] = x
+}
+
+func components(s Pairer) map[uint64][]uint64 {
+	u := make(unionFind)
+
+	s.AllPairs(func(a, b simstore.Match) {
+		u.union(a.DocID, b.DocID)
+	})
+
+	clusters := make(map[uint64][]uint64)
+	for id := range u {
+		root := u.find(id)
+		clusters[root] = append(clusters[root], id)
+	}
+
+	for _, ids := range clusters {
+		sort.Sort(docids(ids))
+	}
+
+	return clusters
+}
+
+func leaders(s Pairer) map[uint64][]uint64 {
+	neighbours := make(map[uint64][]uint64)
+
+	s.AllPairs(func(a, b simstore.Match) {
+		neighbours[a.DocID] = append(neighbours[a.DocID], b.DocID)
+		neighbours[b.DocID] = append(neighbours[b.DocID], a.DocID)
+	})
+
+	ids := make([]uint64, 0, len(neighbours))
+	for id := range neighbours {
+		ids = append(ids, id)
+	}
+	sort.Sort(docids(ids))
+
+	clusters := make(map[uint64][]uint64)
+
+	for _, id := range ids {
+		n := neighbours[id]
+		sort.Sort(docids(n))
+
+		leader := id
+		for _, l := range n {
+			if l >= id {
+				break
+			}
+			if _, ok := clusters[l]; ok {
+				leader = l
+				break
+			}
+		}
+
+		clusters[leader] = append(clusters[leader], id)
+	}
+
+	return clusters
+}
+
+type docids []uint64
+
+func (d docids) Len() int           { return len(d) }
+func (d docids) Less(i, j int) bool { return d[i] < d[j] }
+func (d docids) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dgryski/go-simstore"
+)
+
+// pairs is a Pairer reporting a fixed list of pairs
+type pairs [][2]uint64
+
+func (p pairs) AllPairs(fn func(a, b simstore.Match)) {
+	for _, v := range p {
+		fn(simstore.Match{DocID: v[0]}, simstore.Match{DocID: v[1]})
+	}
+}
+
+func TestCluster(t *testing.T) {
+
+	// a chain 1-2-3-4, a triangle 10-11-12, a pair 20-21, and a chain
+	// 30-31-32 where 32's only near-duplicate follows leader 30
+	p := pairs{{2, 1}, {3, 2}, {4, 3}, {10, 11}, {12, 10}, {11, 12}, {21, 20}, {30, 31}, {31, 32}}
+
+	tests := []struct {
+		mode Mode
+		want map[uint64][]uint64
+	}{
+		{Transitive, map[uint64][]uint64{
+			1:  {1, 2, 3, 4},
+			10: {10, 11, 12},
+			20: {20, 21},
+			30: {30, 31, 32},
+		}},
+		{Leader, map[uint64][]uint64{
+			1:  {1, 2},
+			3:  {3, 4},
+			10: {10, 11, 12},
+			20: {20, 21},
+			30: {30, 31},
+			32: {32},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got, err := Cluster(p, tt.mode); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Cluster(mode=%d)=%v, %v, want %v", tt.mode, got, err, tt.want)
+		}
+	}
+
+	if _, err := Cluster(p, Leader+1); err == nil {
+		t.Errorf("Cluster with an unknown mode succeeded")
+	}
+}
+
+func TestClusterStore(t *testing.T) {
+
+	s := simstore.New3(4, simstore.NewU64Slice)
+
+	const base = 0x0123456789abcdef
+
+	s.Add(base, 1)
+	s.Add(base^0x7, 2)      // distance 3 from 1
+	s.Add(base^0x1f, 3)     // distance 2 from 2, 5 from 1
+	s.Add(^uint64(base), 4) // no near-duplicates
+	s.Finish()
+
+	if got, _ := Cluster(s, Transitive); !reflect.DeepEqual(got, map[uint64][]uint64{1: {1, 2, 3}}) {
+		t.Errorf("Cluster(Transitive)=%v, want %v", got, map[uint64][]uint64{1: {1, 2, 3}})
+	}
+
+	// 3 is only near 2, which follows 1, so it leads a cluster of its own
+	if got, _ := Cluster(s, Leader); !reflect.DeepEqual(got, map[uint64][]uint64{1: {1, 2}, 3: {3}}) {
+		t.Errorf("Cluster(Leader)=%v, want %v", got, map[uint64][]uint64{1: {1, 2}, 3: {3}})
+	}
+}
@@ -0,0 +1,225 @@
+package simstore
+
+import "sort"
+
+// delta holds the signatures added to a Store after Finish().  Each permuted
+// table has a small sorted layer which Find searches alongside the main
+// tables.  Once it grows large enough it is merged into the main tables in
+// the background.
+type delta struct {
+	docids  table
+	rhashes []u64slice
+}
+
+func newDelta(tables int) *delta {
+	return &delta{rhashes: make([]u64slice, tables)}
+}
+
+// minMerge is the smallest delta that triggers a merge.  Inserting into the
+// delta costs O(delta) and merging costs O(store), so larger stores merge at
+// roughly sqrt(store) entries.
+const minMerge = 1024
+
+// needMerge reports whether enough signatures have been added or removed
+// since the last merge to start another.
+//
+// A merge is not cheap: it rebuilds every table, decompressing and
+// recompressing each zstore in full, and the old tables stay live until the
+// new ones replace them, so memory peaks at about twice the store's size.
+func (s *Store) needMerge() bool {
+	n := len(s.delta.docids) + s.removed.len()
+	return n >= minMerge && n*n >= len(s.docids)
+}
+
+func (t *table) insert(e entry) {
+	i := sort.Search(len(*t), func(i int) bool { return (*t)[i].hash > e.hash })
+	*t = append(*t, entry{})
+	copy((*t)[i+1:], (*t)[i:])
+	(*t)[i] = e
+}
+
+func (u *u64slice) insert(p uint64) {
+	i := sort.Search(len(*u), func(i int) bool { return (*u)[i] > p })
+	*u = append(*u, 0)
+	copy((*u)[i+1:], (*u)[i:])
+	(*u)[i] = p
+}
+
+// mergeTables returns a new table containing the entries of both sorted tables
+func mergeTables(a, b table) table {
+	t := make(table, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].hash < a[0].hash {
+			t = append(t, b[0])
+			b = b[1:]
+		} else {
+			t = append(t, a[0])
+			a = a[1:]
+		}
+	}
+	t = append(t, a...)
+	return append(t, b...)
+}
+
+// merge returns a new store containing the signatures of both sorted slices,
+// less those in the sorted slice rm
+func (u u64slice) merge(d, rm u64slice) u64store {
+	m := make(u64slice, 0, len(u)+len(d))
+	for len(u) > 0 && len(d) > 0 {
+		if d[0] < u[0] {
+			m = append(m, d[0])
+			d = d[1:]
+		} else {
+			m = append(m, u[0])
+			u = u[1:]
+		}
+	}
+	m = append(m, u...)
+	m = append(m, d...)
+	m = m.removeSorted(rm)
+	return &m
+}
+
+// add inserts a permuted signature into table t, or into the delta once the
+// store has been finished
+func (s *Store) add(t int, p uint64) {
+	if s.delta != nil {
+		s.delta.rhashes[t].insert(p)
+		return
+	}
+	s.rhashes[t].add(p)
+}
+
+func (s *Store) addDoc(sig, docid uint64) {
+	e := entry{hash: sig, docid: docid}
+	s.removed.add(e)
+	if s.delta != nil {
+		s.delta.docids.insert(e)
+		return
+	}
+	s.docids = append(s.docids, e)
+}
+
+// lockAdd is called at the start of Add.  After Finish() the store may be
+// searched and merged concurrently, so inserts must hold the lock.  It
+// returns the function to be deferred to release it.
+func (s *Store) lockAdd() func() {
+	if !s.finished {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.unlockAdd
+}
+
+func (s *Store) unlockAdd() {
+	if s.merging == nil && s.needMerge() {
+		s.startMerge()
+	}
+	s.mu.Unlock()
+}
+
+// startMerge freezes the current delta and merges it into the main tables in
+// the background, compacting away the documents removed so far.  It must be
+// called with the lock held.
+func (s *Store) startMerge() {
+	s.merging = s.delta
+	s.delta = newDelta(len(s.rhashes))
+	s.merges.Add(1)
+	go s.merge(s.merging, s.removed.clone())
+}
+
+func (s *Store) merge(d *delta, removed tombstones) {
+	defer s.merges.Done()
+
+	// Only the merge replaces the main tables, so they can be read
+	// without the lock.
+	docids := mergeTables(s.docids, d.docids)
+
+	var dead u64slice
+	if removed.len() > 0 {
+		docids, dead = removed.compact(docids)
+	}
+
+	rhashes := make([]u64store, len(s.rhashes))
+	rm := make(u64slice, len(dead))
+	for i, r := range s.rhashes {
+		if r == nil {
+			r = &u64slice{}
+		}
+		for j, sig := range dead {
+			rm[j] = s.perms[i].shuffle(sig)
+		}
+		sort.Sort(rm)
+		rhashes[i] = r.merge(d.rhashes[i], rm)
+	}
+
+	s.mu.Lock()
+	s.docids = docids
+	s.rhashes = rhashes
+	s.merging = nil
+	s.removed.forget(removed)
+	s.mu.Unlock()
+}
+
+// flush merges any pending inserts into the main tables and waits for the
+// merge to complete
+func (s *Store) flush() {
+	s.merges.Wait()
+
+	s.mu.Lock()
+	if s.pending() > 0 {
+		s.startMerge()
+	}
+	s.mu.Unlock()
+
+	s.merges.Wait()
+}
+
+func (s *Store) empty() bool {
+	return len(s.docids) == 0 && (s.merging == nil || len(s.merging.docids) == 0) && (s.delta == nil || len(s.delta.docids) == 0)
+}
+
+// findTable searches permuted table t and its pending inserts
+func (s *Store) findTable(t int, p, mask uint64, d int) []uint64 {
+	var ids []uint64
+	if s.rhashes[t] != nil {
+		ids = s.rhashes[t].find(p, mask, d)
+	}
+	if s.merging != nil {
+		ids = append(ids, s.merging.rhashes[t].find(p, mask, d)...)
+	}
+	if s.delta != nil {
+		ids = append(ids, s.delta.rhashes[t].find(p, mask, d)...)
+	}
+	return ids
+}
+
+// findDoc returns the document ids for the signature sig
+func (s *Store) findDoc(sig uint64) []uint64 {
+	ids := s.docids.find(sig)
+	if s.merging != nil {
+		ids = append(ids, s.merging.docids.find(sig)...)
+	}
+	if s.delta != nil {
+		ids = append(ids, s.delta.docids.find(sig)...)
+	}
+
+	if s.removed.len() == 0 {
+		return ids
+	}
+
+	return s.removed.live(sig, ids)
+}
+
+// pending returns the number of inserts and removals not yet merged into the
+// main tables
+func (s *Store) pending() int {
+	n := s.removed.len()
+	if s.merging != nil {
+		n += len(s.merging.docids)
+	}
+	if s.delta != nil {
+		n += len(s.delta.docids)
+	}
+	return n
+}
@@ -0,0 +1,179 @@
+package minhash
+
+import (
+	"errors"
+	"sort"
+)
+
+type entry struct {
+	hash  uint64
+	docid uint64
+}
+
+type table []entry
+
+func (t table) Len() int           { return len(t) }
+func (t table) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t table) Less(i, j int) bool { return t[i].hash < t[j].hash }
+
+func (t table) find(hash uint64) []uint64 {
+
+	i := sort.Search(len(t), func(i int) bool { return t[i].hash >= hash })
+
+	var ids []uint64
+
+	for i < len(t) && t[i].hash == hash {
+		ids = append(ids, t[i].docid)
+		i++
+	}
+
+	return ids
+}
+
+// Index is an LSH banding index over minhash signatures, the counterpart of
+// simstore.Store.  Each signature is split into bands of rows values, and
+// documents sharing all the values of any band are candidates.  A pair with
+// Jaccard similarity s is found with probability 1-(1-s^rows)^bands, which
+// rises steeply around (1/bands)^(1/rows).
+//
+// Only the band hashes and a b-bit packing of each signature are kept, which
+// is enough to estimate similarities for FindMatches.
+type Index struct {
+	bands int
+	rows  int
+
+	tables []table
+
+	// packed holds the packBits-bit signature of document d at
+	// packed[offsets[d]:offsets[d]+words]
+	packed  []uint64
+	offsets map[uint64]int
+	words   int
+}
+
+// packBits is the number of bits of each value kept for FindMatches.  Values
+// then agree by chance once in 256, which barely affects the estimates.
+const packBits = 8
+
+// ErrDuplicateID is returned when adding a document id already in the index
+var ErrDuplicateID = errors.New("minhash: document id already in the index")
+
+// NewIndex returns an index for signatures of bands*rows values
+func NewIndex(bands, rows int) *Index {
+	per := 64 / packBits
+	return &Index{
+		bands:   bands,
+		rows:    rows,
+		tables:  make([]table, bands),
+		offsets: make(map[uint64]int),
+		words:   (bands*rows + per - 1) / per,
+	}
+}
+
+// SignatureLen returns the number of values in the signatures of the index
+func (ix *Index) SignatureLen() int {
+	return ix.bands * ix.rows
+}
+
+// band hashes the values of band b of sig
+func (ix *Index) band(sig Signature, b int) uint64 {
+	var h uint64
+	for _, v := range sig[b*ix.rows : (b+1)*ix.rows] {
+		h = mix(h ^ v)
+	}
+	return h
+}
+
+// Add inserts a signature and document id into the index.  Each document id
+// may be added only once; adding it again returns ErrDuplicateID and leaves
+// the index unchanged.
+func (ix *Index) Add(sig Signature, docid uint64) error {
+	if len(sig) != ix.SignatureLen() {
+		panic("minhash: signature length does not match the index")
+	}
+
+	if _, ok := ix.offsets[docid]; ok {
+		return ErrDuplicateID
+	}
+
+	for b := range ix.tables {
+		ix.tables[b] = append(ix.tables[b], entry{hash: ix.band(sig, b), docid: docid})
+	}
+	ix.offsets[docid] = len(ix.packed)
+	ix.packed = append(ix.packed, sig.Pack(packBits).Words...)
+
+	return nil
+}
+
+// packedSig returns the packed signature of document docid
+func (ix *Index) packedSig(docid uint64) Packed {
+	o := ix.offsets[docid]
+	return Packed{B: packBits, K: ix.SignatureLen(), Words: ix.packed[o : o+ix.words]}
+}
+
+// Finish prepares the index for searching.  This must be called after all
+// signatures have been added via Add().
+func (ix *Index) Finish() {
+	for _, t := range ix.tables {
+		sort.Sort(t)
+	}
+}
+
+// Find returns the documents sharing at least one band with sig
+func (ix *Index) Find(sig Signature) []uint64 {
+	if len(sig) != ix.SignatureLen() {
+		return nil
+	}
+
+	seen := make(map[uint64]struct{})
+	var ids []uint64
+
+	for b, t := range ix.tables {
+		for _, id := range t.find(ix.band(sig, b)) {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// Match is a document found by FindMatches
+type Match struct {
+	DocID      uint64
+	Similarity float64
+}
+
+// matches sorts by decreasing similarity and then document id
+type matches []Match
+
+func (m matches) Len() int      { return len(m) }
+func (m matches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matches) Less(i, j int) bool {
+	if m[i].Similarity != m[j].Similarity {
+		return m[i].Similarity > m[j].Similarity
+	}
+	return m[i].DocID < m[j].DocID
+}
+
+// FindMatches is like Find but returns the estimated similarity of each
+// document as well, most similar first.  The similarities are estimated from
+// the packed signatures, as by PackedSimilarity.
+func (ix *Index) FindMatches(sig Signature) []Match {
+	ids := ix.Find(sig)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	q := sig.Pack(packBits)
+
+	var m []Match
+	for _, id := range ids {
+		m = append(m, Match{DocID: id, Similarity: PackedSimilarity(q, ix.packedSig(id))})
+	}
+
+	sort.Sort(matches(m))
+	return m
+}
@@ -0,0 +1,180 @@
+// Package minhash implements minhash signatures for estimating the Jaccard
+// similarity of documents.
+/*
+Features come from the same simhash.FeatureScanner interface as simhash.Hash.
+Hash computes a k-permutation signature, taking the minimum of k independent
+hash functions over the features.  HashOnePermutation hashes each feature
+once and keeps the minimum in each of k bins, filling empty bins by
+densification.
+
+https://www.cs.princeton.edu/courses/archive/spring13/cos598C/broder97resemblance.pdf
+http://www.stat.cornell.edu/~li/papers/b-bit-minwise-hashing.pdf
+http://proceedings.mlr.press/v32/shrivastava14.pdf
+*/
+package minhash
+
+import (
+	"math"
+
+	"github.com/dchest/siphash"
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// Signature is a minhash signature: the minimum hash value seen for each of
+// k hash functions or bins
+type Signature []uint64
+
+// mix is the splitmix64 finaliser, a bijection which spreads the bits of x
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// seeds returns the k values which turn a feature hash into k independent
+// hash functions
+func seeds(k int) []uint64 {
+	s := make([]uint64, k)
+	var x uint64
+	for i := range s {
+		x += 0x9e3779b97f4a7c15
+		s[i] = mix(x)
+	}
+	return s
+}
+
+func empty(k int) Signature {
+	sig := make(Signature, k)
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	return sig
+}
+
+// Hash returns the k-permutation minhash signature of the features returned
+// by the scanner
+func Hash(scanner simhash.FeatureScanner, k int) Signature {
+	sig := empty(k)
+	s := seeds(k)
+
+	for scanner.Scan() {
+		h := siphash.Hash(0, 0, scanner.Bytes())
+		for i, seed := range s {
+			if v := mix(h ^ seed); v < sig[i] {
+				sig[i] = v
+			}
+		}
+	}
+
+	return sig
+}
+
+// HashOnePermutation returns the one-permutation minhash signature with k
+// bins of the features returned by the scanner.  Each feature is hashed once,
+// so it is much faster than Hash for large k.
+func HashOnePermutation(scanner simhash.FeatureScanner, k int) Signature {
+	sig := empty(k)
+	filled := make([]bool, k)
+
+	for scanner.Scan() {
+		v := mix(siphash.Hash(0, 0, scanner.Bytes()))
+		bin := int((v >> 32) * uint64(k) >> 32)
+		if v <= sig[bin] {
+			sig[bin] = v
+			filled[bin] = true
+		}
+	}
+
+	densify(sig, filled)
+	return sig
+}
+
+// densify fills each empty bin from the nearest filled bin to its right, so
+// that documents sharing that bin's minimum also share the empty bin's value
+func densify(sig Signature, filled []bool) {
+	k := len(sig)
+	for i := range sig {
+		if filled[i] {
+			continue
+		}
+		for t := 1; t < k; t++ {
+			if j := (i + t) % k; filled[j] {
+				sig[i] = mix(sig[j] + uint64(t)*0x9e3779b97f4a7c15)
+				break
+			}
+		}
+	}
+}
+
+// Similarity estimates the Jaccard similarity of the documents with
+// signatures a and b as the fraction of equal values
+func Similarity(a, b Signature) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+
+	var eq int
+	for i := range a {
+		if a[i] == b[i] {
+			eq++
+		}
+	}
+
+	return float64(eq) / float64(len(a))
+}
+
+// Packed is a b-bit minhash signature, keeping only the low b bits of each
+// value
+type Packed struct {
+	B     int
+	K     int
+	Words []uint64
+}
+
+// Pack returns the b-bit signature for sig.  b must divide 64.
+func (sig Signature) Pack(b int) Packed {
+	if b < 1 || b > 64 || 64%b != 0 {
+		panic("minhash: b must divide 64")
+	}
+
+	per := 64 / b
+	p := Packed{B: b, K: len(sig), Words: make([]uint64, (len(sig)+per-1)/per)}
+	mask := ^uint64(0) >> uint(64-b)
+
+	for i, v := range sig {
+		p.Words[i/per] |= (v & mask) << uint(b*(i%per))
+	}
+
+	return p
+}
+
+// PackedSimilarity estimates the Jaccard similarity of the documents with
+// b-bit signatures a and b.  Values agree by chance with probability 2^-b,
+// which is corrected for.
+func PackedSimilarity(a, b Packed) float64 {
+	if a.K == 0 || a.B != b.B || a.K != b.K {
+		return 0
+	}
+
+	per := 64 / a.B
+	mask := ^uint64(0) >> uint(64-a.B)
+
+	var eq int
+	for i := 0; i < a.K; i++ {
+		shift := uint(a.B * (i % per))
+		if (a.Words[i/per]>>shift)&mask == (b.Words[i/per]>>shift)&mask {
+			eq++
+		}
+	}
+
+	c := math.Pow(2, -float64(a.B))
+	j := (float64(eq)/float64(a.K) - c) / (1 - c)
+
+	if j < 0 {
+		return 0
+	}
+	return j
+}
@@ -0,0 +1,117 @@
+package minhash
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// features returns the features n..m-1
+func features(n, m int) [][]byte {
+	var f [][]byte
+	for i := n; i < m; i++ {
+		f = append(f, []byte(fmt.Sprintf("feature-%d", i)))
+	}
+	return f
+}
+
+func TestSimilarity(t *testing.T) {
+
+	// |a∩b| = 600, |a∪b| = 1400
+	a, b := features(0, 1000), features(400, 1400)
+	const want = 600.0 / 1400
+
+	const k = 512
+
+	hashes := []struct {
+		name string
+		f    func(simhash.FeatureScanner, int) Signature
+	}{
+		{"k-permutation", Hash},
+		{"one-permutation", HashOnePermutation},
+	}
+
+	for _, h := range hashes {
+		sa := h.f(simhash.NewSliceScanner(a), k)
+		sb := h.f(simhash.NewSliceScanner(b), k)
+
+		if got := Similarity(sa, sb); math.Abs(got-want) > 0.07 {
+			t.Errorf("%s: Similarity=%.3f, want %.3f", h.name, got, want)
+		}
+
+		if got := Similarity(sa, h.f(simhash.NewSliceScanner(a), k)); got != 1 {
+			t.Errorf("%s: self Similarity=%.3f, want 1", h.name, got)
+		}
+
+		for _, bits := range []int{1, 4, 16, 64} {
+			if got := PackedSimilarity(sa.Pack(bits), sb.Pack(bits)); math.Abs(got-want) > 0.12 {
+				t.Errorf("%s: %d-bit PackedSimilarity=%.3f, want %.3f", h.name, bits, got, want)
+			}
+		}
+	}
+
+	// a small document leaves most one-permutation bins to densification
+	small := HashOnePermutation(simhash.NewSliceScanner(features(0, 10)), 64)
+	for i, v := range small {
+		if v == math.MaxUint64 {
+			t.Errorf("one-permutation: bin %d not densified", i)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+
+	const bands, rows = 32, 4
+
+	ix := NewIndex(bands, rows)
+
+	// documents 10i+j share features with each other for the same i
+	sigs := make(map[uint64]Signature)
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 3; j++ {
+			f := features(1000*i+10*j, 1000*i+10*j+500)
+			id := uint64(10*i + j)
+			sigs[id] = HashOnePermutation(simhash.NewSliceScanner(f), bands*rows)
+			if err := ix.Add(sigs[id], id); err != nil {
+				t.Fatalf("Add(%d): %v", id, err)
+			}
+		}
+	}
+
+	if err := ix.Add(sigs[0], 0); err != ErrDuplicateID {
+		t.Errorf("Add(duplicate id)=%v, want %v", err, ErrDuplicateID)
+	}
+
+	ix.Finish()
+
+	q := HashOnePermutation(simhash.NewSliceScanner(features(5005, 5505)), bands*rows)
+
+	m := ix.FindMatches(q)
+	got := make(map[uint64]bool)
+	for _, v := range m {
+		got[v.DocID] = true
+		if v.DocID/10 != 5 && v.Similarity > 0.2 {
+			t.Errorf("FindMatches: unrelated document %d with similarity %.3f", v.DocID, v.Similarity)
+		}
+		// the packed estimate stays close to the full signatures'
+		if want := Similarity(q, sigs[v.DocID]); math.Abs(v.Similarity-want) > 0.05 {
+			t.Errorf("FindMatches: document %d similarity %.3f, want about %.3f", v.DocID, v.Similarity, want)
+		}
+	}
+
+	for j := uint64(0); j < 3; j++ {
+		if !got[50+j] {
+			t.Errorf("FindMatches: near-duplicate %d not found", 50+j)
+		}
+	}
+
+	if m[0].DocID != 50 && m[0].DocID != 51 {
+		t.Errorf("FindMatches: best match %d, want 50 or 51", m[0].DocID)
+	}
+
+	if len(ix.Find(Signature{1, 2, 3})) != 0 {
+		t.Errorf("Find: short signature found documents")
+	}
+}
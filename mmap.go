@@ -0,0 +1,196 @@
+package simstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"unsafe"
+)
+
+// MappedStore is a read-only Storage whose tables are memory-mapped directly
+// from a file written by WriteTo.  The page cache is shared between all
+// processes mapping the same file.
+type MappedStore struct {
+	Storage
+	data []byte
+}
+
+var errBigEndian = errors.New("simstore: mapped stores require a little-endian host")
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// OpenMapped maps the store in the file at path.  The store is ready for
+// searching immediately.  Only the structure of the file is validated; the
+// checksum is not verified so that opening does not fault in every page.  Call
+// Verify to check it.
+func OpenMapped(path string) (*MappedStore, error) {
+	if !littleEndian {
+		return nil, errBigEndian
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := mmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := decodeStore(&mapDecoder{b: data})
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+
+	return &MappedStore{Storage: s, data: data}, nil
+}
+
+// Verify checks the file's checksum, reading the whole file.  It returns
+// ErrChecksum if the file is corrupt.
+func (m *MappedStore) Verify() error {
+	n := len(m.data) - 8
+	if n < 0 {
+		return ErrInvalidFormat
+	}
+	if uint64(crc32.Checksum(m.data[:n], crcTable)) != binary.LittleEndian.Uint64(m.data[n:]) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// Err returns the error for the first corrupt block found while searching the
+// store, or nil.
+func (m *MappedStore) Err() error {
+	if e, ok := m.Storage.(interface{ Err() error }); ok {
+		return e.Err()
+	}
+	return nil
+}
+
+// Add panics; a mapped store is read-only.
+func (m *MappedStore) Add(sig, docid uint64) {
+	panic("simstore: Add on read-only mapped store")
+}
+
+// Finish does nothing; a mapped store is already finished.
+func (m *MappedStore) Finish() {}
+
+// Close unmaps the file.  The store must not be used after Close.
+func (m *MappedStore) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmap(m.data)
+	m.data = nil
+	m.Storage = nil
+	return err
+}
+
+// mapDecoder decodes a store in place, pointing the tables into b
+type mapDecoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *mapDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *mapDecoder) Err() error { return d.err }
+
+// next returns the next n bytes of the file
+func (d *mapDecoder) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)-d.off) {
+		d.err = ErrInvalidFormat
+		return nil
+	}
+	b := d.b[d.off : d.off+int(n) : d.off+int(n)]
+	d.off += int(n)
+	return b
+}
+
+func (d *mapDecoder) u64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *mapDecoder) u64s() []uint64 {
+	n := d.u64()
+	if n > uint64(len(d.b))/8 {
+		d.fail(ErrInvalidFormat)
+		return nil
+	}
+	b := d.next(n * 8)
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b[0])), n)
+}
+
+func (d *mapDecoder) entries() table {
+	n := d.u64()
+	if n > uint64(len(d.b))/16 {
+		d.fail(ErrInvalidFormat)
+		return nil
+	}
+	b := d.next(n * 16)
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*entry)(unsafe.Pointer(&b[0])), n)
+}
+
+func (d *mapDecoder) bytes() []byte {
+	n := d.u64()
+	b := d.next(n)
+	if pad := n % 8; pad != 0 {
+		d.next(8 - pad)
+	}
+	return b
+}
+
+func (d *mapDecoder) header() (kind, k, tables int) {
+	magic := d.next(uint64(len(fileMagic)))
+	if d.err != nil {
+		return
+	}
+	if string(magic) != fileMagic {
+		d.err = ErrInvalidFormat
+		return
+	}
+	v := d.u64()
+	if d.err == nil && uint32(v) != fileVersion {
+		d.err = ErrUnsupportedVersion
+		return
+	}
+	kind = int(v >> 32)
+	v = d.u64()
+	return kind, int(uint32(v)), int(v >> 32)
+}
+
+// finish checks that only the checksum remains
+func (d *mapDecoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b)-d.off != 8 {
+		return ErrInvalidFormat
+	}
+	return nil
+}
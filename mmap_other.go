@@ -0,0 +1,17 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package simstore
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile falls back to reading the whole file on platforms without mmap
+func mmapFile(f *os.File) ([]byte, error) {
+	return io.ReadAll(f)
+}
+
+func munmap(b []byte) error {
+	return nil
+}
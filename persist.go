@@ -0,0 +1,429 @@
+package simstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/dgryski/go-huff"
+)
+
+/*
+The on-disk format is a little-endian stream of 8-byte words, so that the
+arrays can be used in place once the file is loaded.
+
+    header:  "simstore" version:u32 kind:u32 k:u32 tables:u32
+    docids:  n:u64 (hash:u64 docid:u64)*n
+    tables:  one of the following per table
+        none:     0:u64
+        u64slice: 1:u64 n:u64 hash:u64*n
+        zstore:   2:u64 counts:u64*64 n:u64 index:u64*n n:u64 b:byte*n (padded to 8)
+    footer:  crc32c:u64 of everything before it
+
+SmallStore3 has no docids section; its tables are the 4<<16 prefix buckets,
+each stored as n:u64 (hash:u64 docid:u64)*n.
+*/
+
+const (
+	fileMagic   = "simstore"
+	fileVersion = 1
+)
+
+const (
+	kindStore3 = iota + 1
+	kindStore6
+	kindStoreK
+	kindSmall3
+)
+
+const (
+	backendNone = iota
+	backendU64Slice
+	backendZStore
+)
+
+var (
+	ErrInvalidFormat      = errors.New("simstore: invalid file format")
+	ErrUnsupportedVersion = errors.New("simstore: unsupported file version")
+	ErrChecksum           = errors.New("simstore: checksum mismatch")
+)
+
+var errPending = errors.New("simstore: store has unmerged signatures; call Finish first")
+
+var errNotFinished = errors.New("simstore: store is not finished; call Finish first")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type encoder struct {
+	w       io.Writer
+	bw      *bufio.Writer
+	crc     hash.Hash32
+	n       int64
+	err     error
+	scratch [8]byte
+}
+
+func newEncoder(w io.Writer) *encoder {
+	crc := crc32.New(crcTable)
+	return &encoder{w: w, bw: bufio.NewWriter(io.MultiWriter(w, crc)), crc: crc}
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.bw.Write(p)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *encoder) u64(v uint64) {
+	binary.LittleEndian.PutUint64(e.scratch[:], v)
+	e.write(e.scratch[:])
+}
+
+func (e *encoder) u64s(u []uint64) {
+	e.u64(uint64(len(u)))
+	for _, v := range u {
+		e.u64(v)
+	}
+}
+
+func (e *encoder) entries(t table) {
+	e.u64(uint64(len(t)))
+	for _, v := range t {
+		e.u64(v.hash)
+		e.u64(v.docid)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.u64(uint64(len(b)))
+	e.write(b)
+	if pad := len(b) % 8; pad != 0 {
+		e.write(make([]byte, 8-pad))
+	}
+}
+
+func (e *encoder) header(kind, k, tables int) {
+	e.write([]byte(fileMagic))
+	binary.LittleEndian.PutUint32(e.scratch[:], fileVersion)
+	binary.LittleEndian.PutUint32(e.scratch[4:], uint32(kind))
+	e.write(e.scratch[:])
+	binary.LittleEndian.PutUint32(e.scratch[:], uint32(k))
+	binary.LittleEndian.PutUint32(e.scratch[4:], uint32(tables))
+	e.write(e.scratch[:])
+}
+
+// finish flushes the buffered data and appends the checksum
+func (e *encoder) finish() (int64, error) {
+	if e.err == nil {
+		e.err = e.bw.Flush()
+	}
+	if e.err != nil {
+		return e.n, e.err
+	}
+	binary.LittleEndian.PutUint64(e.scratch[:], uint64(e.crc.Sum32()))
+	n, err := e.w.Write(e.scratch[:])
+	e.n += int64(n)
+	return e.n, err
+}
+
+// storeDecoder is implemented by the streaming decoder used by ReadStore and
+// by the zero-copy decoder used by OpenMapped.
+type storeDecoder interface {
+	header() (kind, k, tables int)
+	u64() uint64
+	u64s() []uint64
+	entries() table
+	bytes() []byte
+	fail(err error)
+	Err() error
+	finish() error
+}
+
+type decoder struct {
+	r       *bufio.Reader
+	crc     hash.Hash32
+	err     error
+	scratch [8]byte
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r), crc: crc32.New(crcTable)}
+}
+
+func (d *decoder) read(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, d.err = io.ReadFull(d.r, p); d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+	d.crc.Write(p)
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) Err() error { return d.err }
+
+func (d *decoder) u64() uint64 {
+	d.read(d.scratch[:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(d.scratch[:])
+}
+
+// maxPrealloc limits how much a (possibly corrupt) length can allocate up front
+const maxPrealloc = 1 << 20
+
+func prealloc(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
+func (d *decoder) u64s() []uint64 {
+	n := d.u64()
+	u := make([]uint64, 0, prealloc(n))
+	for ; n > 0 && d.err == nil; n-- {
+		u = append(u, d.u64())
+	}
+	return u
+}
+
+func (d *decoder) entries() table {
+	n := d.u64()
+	t := make(table, 0, prealloc(n))
+	for ; n > 0 && d.err == nil; n-- {
+		h := d.u64()
+		t = append(t, entry{hash: h, docid: d.u64()})
+	}
+	return t
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.u64()
+	var b []byte
+	for n > 0 && d.err == nil {
+		chunk := make([]byte, prealloc(n))
+		d.read(chunk)
+		b = append(b, chunk...)
+		n -= uint64(len(chunk))
+	}
+	if pad := len(b) % 8; pad != 0 {
+		d.read(make([]byte, 8-pad))
+	}
+	return b
+}
+
+func (d *decoder) header() (kind, k, tables int) {
+	var magic [len(fileMagic)]byte
+	d.read(magic[:])
+	if d.err != nil {
+		return
+	}
+	if string(magic[:]) != fileMagic {
+		d.err = ErrInvalidFormat
+		return
+	}
+	v := d.u64()
+	if uint32(v) != fileVersion {
+		d.err = ErrUnsupportedVersion
+		return
+	}
+	kind = int(v >> 32)
+	v = d.u64()
+	return kind, int(uint32(v)), int(v >> 32)
+}
+
+// finish verifies the trailing checksum
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	sum := d.crc.Sum32()
+	if _, err := io.ReadFull(d.r, d.scratch[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.LittleEndian.Uint64(d.scratch[:]) != uint64(sum) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func (s *Store) write(w io.Writer, kind, k int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.finished {
+		return 0, errNotFinished
+	}
+
+	if s.pending() != 0 {
+		return 0, errPending
+	}
+
+	e := newEncoder(w)
+	e.header(kind, k, len(s.rhashes))
+	e.entries(s.docids)
+
+	for _, r := range s.rhashes {
+		switch r := r.(type) {
+		case nil:
+			e.u64(backendNone)
+		case *u64slice:
+			e.u64(backendU64Slice)
+			e.u64s(*r)
+		case *zstore:
+			e.u64(backendZStore)
+			for _, c := range r.counts {
+				e.u64(uint64(c))
+			}
+			e.u64s(r.index)
+			e.bytes(r.b)
+		default:
+			return e.n, errors.New("simstore: unknown table type")
+		}
+	}
+
+	return e.finish()
+}
+
+func (s *Store) read(d storeDecoder) {
+	s.finished = true
+	s.delta = newDelta(len(s.rhashes))
+	s.docids = d.entries()
+
+	for i := range s.rhashes {
+		switch d.u64() {
+		case backendNone:
+		case backendU64Slice:
+			u := u64slice(d.u64s())
+			s.rhashes[i] = &u
+		case backendZStore:
+			z := &zstore{}
+			for j := range z.counts {
+				z.counts[j] = int(d.u64())
+			}
+			z.index = d.u64s()
+			z.b = d.bytes()
+			if err := z.validate(len(s.docids)); err != nil {
+				d.fail(err)
+				return
+			}
+			z.d = huff.NewEncoder(z.counts[:]).Decoder()
+			s.rhashes[i] = z
+		default:
+			d.fail(ErrInvalidFormat)
+		}
+
+		if d.Err() != nil {
+			return
+		}
+	}
+}
+
+// WriteTo writes the store to w.  It must be called after Finish().
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+	if s.k == 3 {
+		return s.write(w, kindStore3, 3)
+	}
+	return s.write(w, kindStoreK, s.k)
+}
+
+// WriteTo writes the store to w.  It must be called after Finish().
+func (s *Store6) WriteTo(w io.Writer) (int64, error) {
+	return s.write(w, kindStore6, 6)
+}
+
+// WriteTo writes the store to w.  It must be called after Finish().
+func (s *SmallStore3) WriteTo(w io.Writer) (int64, error) {
+	if len(s.removed) != 0 {
+		return 0, errPending
+	}
+
+	e := newEncoder(w)
+	e.header(kindSmall3, 3, len(s.tables)*len(s.tables[0]))
+	for i := range s.tables {
+		for p := range s.tables[i] {
+			e.entries(s.tables[i][p])
+		}
+	}
+	return e.finish()
+}
+
+// ReadStore reads a store written by WriteTo.  The returned store is ready for
+// searching; Finish() does not need to be called.
+func ReadStore(r io.Reader) (Storage, error) {
+	return decodeStore(newDecoder(r))
+}
+
+func decodeStore(d storeDecoder) (Storage, error) {
+
+	kind, k, tables := d.header()
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+
+	var s Storage
+
+	switch kind {
+	case kindStore3:
+		if k != 3 || tables != 16 {
+			return nil, ErrInvalidFormat
+		}
+		st := &Store{rhashes: make([]u64store, tables), k: 3, perms: permutations(3)}
+		st.read(d)
+		s = st
+
+	case kindStore6:
+		if k != 6 || tables != 49 {
+			return nil, ErrInvalidFormat
+		}
+		st := &Store6{}
+		st.k = 6
+		st.perms = permutations(6)
+		st.rhashes = make([]u64store, tables)
+		st.read(d)
+		s = st
+
+	case kindStoreK:
+		if k < 1 || k > 31 || tables != (k+1)*(k+1) {
+			return nil, ErrInvalidFormat
+		}
+		st := &Store{rhashes: make([]u64store, tables), k: k, perms: permutations(k)}
+		st.read(d)
+		s = st
+
+	case kindSmall3:
+		st := &SmallStore3{}
+		if k != 3 || tables != len(st.tables)*len(st.tables[0]) {
+			return nil, ErrInvalidFormat
+		}
+		for i := range st.tables {
+			for p := range st.tables[i] {
+				st.tables[i][p] = d.entries()
+			}
+		}
+		s = st
+
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,238 @@
+package simstore
+
+// tombstones records removed documents until the next compaction drops them
+// from the tables.  Each tombstone holds the sequence number of its removal,
+// so that a merge only forgets the tombstones it compacted, and documents
+// added again after their removal are counted in revived so that exactly
+// those copies survive.
+type tombstones struct {
+	entries map[entry]uint64
+	docids  map[uint64]uint64
+	revived map[entry]int
+	seq     uint64
+}
+
+func (t *tombstones) len() int {
+	return len(t.entries) + len(t.docids)
+}
+
+func (t *tombstones) dead(e entry) bool {
+	if _, ok := t.docids[e.docid]; ok {
+		return true
+	}
+	_, ok := t.entries[e]
+	return ok
+}
+
+func (t *tombstones) removeEntry(e entry) {
+	if t.entries == nil {
+		t.entries = make(map[entry]uint64)
+	}
+	t.seq++
+	t.entries[e] = t.seq
+	delete(t.revived, e)
+}
+
+func (t *tombstones) removeDocID(docid uint64) {
+	if t.docids == nil {
+		t.docids = make(map[uint64]uint64)
+	}
+	t.seq++
+	t.docids[docid] = t.seq
+	for e := range t.revived {
+		if e.docid == docid {
+			delete(t.revived, e)
+		}
+	}
+}
+
+// add records that e has been added, reviving one copy if it was removed
+func (t *tombstones) add(e entry) {
+	if !t.dead(e) {
+		return
+	}
+	if t.revived == nil {
+		t.revived = make(map[entry]int)
+	}
+	t.revived[e]++
+}
+
+// live returns the ids of the documents for sig that have not been removed.
+// It reuses the storage of ids.
+func (t *tombstones) live(sig uint64, ids []uint64) []uint64 {
+	var kept map[uint64]int
+
+	out := ids[:0]
+	for _, id := range ids {
+		e := entry{hash: sig, docid: id}
+		if t.dead(e) {
+			if kept[id] >= t.revived[e] {
+				continue
+			}
+			if kept == nil {
+				kept = make(map[uint64]int)
+			}
+			kept[id]++
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+func (t *tombstones) clone() tombstones {
+	c := tombstones{
+		entries: make(map[entry]uint64, len(t.entries)),
+		docids:  make(map[uint64]uint64, len(t.docids)),
+		revived: make(map[entry]int, len(t.revived)),
+		seq:     t.seq,
+	}
+	for e, seq := range t.entries {
+		c.entries[e] = seq
+	}
+	for id, seq := range t.docids {
+		c.docids[id] = seq
+	}
+	for e, n := range t.revived {
+		c.revived[e] = n
+	}
+	return c
+}
+
+// forget removes the tombstones in c once they have been compacted away.
+// Documents removed again since c was taken keep their newer tombstones.
+func (t *tombstones) forget(c tombstones) {
+	for e, seq := range c.entries {
+		if t.entries[e] == seq {
+			delete(t.entries, e)
+		}
+	}
+	for id, seq := range c.docids {
+		if t.docids[id] == seq {
+			delete(t.docids, id)
+		}
+	}
+	for e := range t.revived {
+		if !t.dead(e) {
+			delete(t.revived, e)
+		}
+	}
+}
+
+// compact drops the dead entries from the sorted table t.  It returns the
+// remaining entries and the signatures which no longer have any document.
+func (t *tombstones) compact(docids table) (table, u64slice) {
+	live := docids[:0:0]
+	var dead u64slice
+
+	var ids []uint64
+	for i := 0; i < len(docids); {
+		j := i
+		ids = ids[:0]
+		for ; j < len(docids) && docids[j].hash == docids[i].hash; j++ {
+			ids = append(ids, docids[j].docid)
+		}
+		ids = t.live(docids[i].hash, ids)
+		for _, id := range ids {
+			live = append(live, entry{hash: docids[i].hash, docid: id})
+		}
+		if len(ids) == 0 {
+			dead = append(dead, docids[i].hash)
+		}
+		i = j
+	}
+
+	return live, dead
+}
+
+// Remove removes the document docid with signature sig from the store.  It no
+// longer appears in Find results; the space is reclaimed on the next
+// compaction, which happens in the background as signatures are added or
+// removed, or when Finish() is called.  A removed document may be added again
+// at any time, and only the new copy is found.
+func (s *Store) Remove(sig, docid uint64) {
+	s.mu.Lock()
+	defer s.unlockRemove()
+
+	s.removed.removeEntry(entry{hash: sig, docid: docid})
+}
+
+// RemoveDocID removes all signatures for the document docid from the store.
+// Compaction works as for Remove.
+func (s *Store) RemoveDocID(docid uint64) {
+	s.mu.Lock()
+	defer s.unlockRemove()
+
+	s.removed.removeDocID(docid)
+}
+
+func (s *Store) unlockRemove() {
+	if s.finished && s.merging == nil && s.needMerge() {
+		s.startMerge()
+	}
+	s.mu.Unlock()
+}
+
+// Remove removes the document docid with signature sig from the store.
+func (s *SmallStore3) Remove(sig, docid uint64) {
+	for i := 0; i < 4; i++ {
+		prefix := (sig & 0xffff000000000000) >> (64 - 16)
+		t := s.tables[i][prefix]
+		for j := 0; j < len(t); j++ {
+			if t[j].hash == sig && t[j].docid == docid {
+				t = append(t[:j], t[j+1:]...)
+				j--
+			}
+		}
+		s.tables[i][prefix] = t
+		sig = (sig << 16) | (sig >> (64 - 16))
+	}
+}
+
+// RemoveDocID removes all signatures for the document docid from the store.
+// The space is reclaimed when Finish() is next called, or when docid is added
+// again.
+func (s *SmallStore3) RemoveDocID(docid uint64) {
+	if s.removed == nil {
+		s.removed = make(map[uint64]struct{})
+	}
+	s.removed[docid] = struct{}{}
+}
+
+// compact drops the removed document ids from the tables
+func (s *SmallStore3) compact() {
+	if len(s.removed) == 0 {
+		return
+	}
+
+	for i := range s.tables {
+		for p := range s.tables[i] {
+			t := s.tables[i][p][:0]
+			for _, e := range s.tables[i][p] {
+				if _, ok := s.removed[e.docid]; !ok {
+					t = append(t, e)
+				}
+			}
+			s.tables[i][p] = t
+		}
+	}
+
+	s.removed = nil
+}
+
+// removeSorted drops every element of u that appears in the sorted slice rm
+func (u u64slice) removeSorted(rm u64slice) u64slice {
+	if len(rm) == 0 {
+		return u
+	}
+
+	out := u[:0]
+	for _, v := range u {
+		for len(rm) > 0 && rm[0] < v {
+			rm = rm[1:]
+		}
+		if len(rm) == 0 || rm[0] != v {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -16,12 +17,14 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
 	"github.com/dgryski/go-simstore"
+	"github.com/dgryski/go-simstore/minhash"
 	"github.com/dgryski/go-simstore/vptree"
 	"github.com/peterbourgon/g2g"
 )
@@ -37,29 +40,93 @@ var Metrics = struct {
 var BuildVersion string = "(development build)"
 
 type Config struct {
-	store  simstore.Storage
-	vptree *vptree.VPTree
+	store   simstore.Storage
+	wide    wideStorage
+	minhash *minhash.Index
+	vptree  *vptree.VPTree
+
+	// refs counts the requests using this configuration, plus one while
+	// it is current.  The store is closed when it drops to zero.
+	refs int32
+
+	// corrupt logs the first corrupt block found in the store
+	corrupt sync.Once
 }
 
 var config unsafe.Pointer // actual type is *Config
 // CurrentConfig atomically returns the current configuration
 func CurrentConfig() *Config { return (*Config)(atomic.LoadPointer(&config)) }
 
-// UpdateConfig atomically swaps the current configuration
-func UpdateConfig(cfg *Config) { atomic.StorePointer(&config, unsafe.Pointer(cfg)) }
+// UpdateConfig atomically swaps the current configuration, returning the old
+// one, which the caller must pass to releaseConfig
+func UpdateConfig(cfg *Config) *Config {
+	cfg.refs = 1
+	return (*Config)(atomic.SwapPointer(&config, unsafe.Pointer(cfg)))
+}
+
+// acquireConfig returns the current configuration, which stays open until the
+// caller passes it to releaseConfig
+func acquireConfig() *Config {
+	for {
+		cfg := CurrentConfig()
+		n := atomic.LoadInt32(&cfg.refs)
+		if n == 0 {
+			// replaced and released since we loaded it; try the new one
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&cfg.refs, n, n+1) {
+			return cfg
+		}
+	}
+}
+
+// releaseConfig drops a reference to cfg.  The last release closes its store
+// if it holds resources, such as a memory mapping.
+func releaseConfig(cfg *Config) {
+	if cfg == nil || atomic.AddInt32(&cfg.refs, -1) != 0 {
+		return
+	}
+	if c, ok := cfg.store.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// checkStore logs corruption found in the store while searching it.  The
+// corrupt block is searched as empty, so the damaged file must be replaced.
+func (cfg *Config) checkStore() {
+	e, ok := cfg.store.(interface{ Err() error })
+	if !ok {
+		return
+	}
+	if err := e.Err(); err != nil {
+		cfg.corrupt.Do(func() { log.Println("simstore is corrupt:", err) })
+	}
+}
 
 func main() {
 
 	port := flag.Int("p", 8080, "port to listen on")
 	input := flag.String("f", "", "file with signatures to load")
+	storeFile := flag.String("load", "", "load simstore from a file written with -save instead of building it")
+	saveFile := flag.String("save", "", "write the built simstore to this file")
+	mapped := flag.Bool("mmap", false, "memory-map the simstore given with -load instead of reading it")
+	verify := flag.Bool("verify", false, "verify the checksum of the simstore memory-mapped with -mmap")
 	useVPTree := flag.Bool("vptree", true, "load vptree")
+	vptreeFile := flag.String("loadvptree", "", "load vptree from a file written with -savevptree instead of building it")
+	vptreeSaveFile := flag.String("savevptree", "", "write the built vptree to this file")
+	vptreeSeed := flag.Int64("seed", 0, "seed for choosing vptree pivots, 0 for random")
 	useStore := flag.Bool("store", true, "load simstore")
-	storeSize := flag.Int("size", 6, "simstore size (3/6)")
+	storeSize := flag.Int("size", 6, "simstore size (hamming distance k)")
+	sigBits := flag.Int("bits", 64, "signature size in bits: 64, 128 or 256; wider signatures use an uncompressed simstore built from -f, and no vptree")
+	useMinhash := flag.Bool("minhash", false, "load minhash signatures into an LSH index instead of a simstore, and no vptree")
+	bands := flag.Int("bands", 32, "minhash LSH bands")
+	rows := flag.Int("rows", 4, "minhash values per LSH band")
 	cpus := flag.Int("cpus", runtime.NumCPU(), "value of GOMAXPROCS")
 	myNumber := flag.Int("no", 0, "id of this machine")
 	totalMachines := flag.Int("of", 1, "number of machines to distribute the table among")
 	small := flag.Bool("small", false, "use small memory for size 3")
 	compressed := flag.Bool("z", false, "use compressed tables")
+	parallel := flag.Int("parallel", 1, "number of simstore tables to probe in parallel, shared by all queries")
 	graphiteHost := flag.String("graphite", "", "graphite destination host")
 	graphiteNamespace := flag.String("namespace", "", "graphite namespace")
 
@@ -72,21 +139,56 @@ func main() {
 	log.Println("setting GOMAXPROCS=", *cpus)
 	runtime.GOMAXPROCS(*cpus)
 
-	if *input == "" {
+	if *sigBits != 64 && *useVPTree {
+		log.Printf("vptree supports only 64-bit signatures, disabling it for %d-bit signatures", *sigBits)
+		*useVPTree = false
+	}
+
+	if *useMinhash && *useVPTree {
+		log.Println("vptree supports only simhash signatures, disabling it for minhash")
+		*useVPTree = false
+	}
+
+	if *input == "" && ((*useStore && *storeFile == "") || (*useVPTree && *vptreeFile == "") || (!*useStore && !*useVPTree)) {
 		log.Fatalln("no import hash list provided (-f)")
 	}
 
-	err := loadConfig(*input, *useStore, *storeSize, *small, *compressed, *useVPTree, *myNumber, *totalMachines)
+	opts := loadOptions{
+		input:          *input,
+		storeFile:      *storeFile,
+		saveFile:       *saveFile,
+		mapped:         *mapped,
+		verify:         *verify,
+		useStore:       *useStore,
+		storeSize:      *storeSize,
+		small:          *small,
+		compressed:     *compressed,
+		parallel:       *parallel,
+		sigBits:        *sigBits,
+		minhash:        *useMinhash,
+		minhashBands:   *bands,
+		minhashRows:    *rows,
+		useVPTree:      *useVPTree,
+		vptreeFile:     *vptreeFile,
+		vptreeSaveFile: *vptreeSaveFile,
+		vptreeSeed:     *vptreeSeed,
+		myNumber:       *myNumber,
+		totalMachines:  *totalMachines,
+	}
+
+	err := loadConfig(opts)
 	if err != nil {
 		log.Fatalln("unable to load config:", err)
 	}
 
 	if *useStore {
 		http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) { searchHandler(w, r) })
+		http.HandleFunc("/search/batch", func(w http.ResponseWriter, r *http.Request) { batchHandler(w, r) })
 	}
 
 	if *useVPTree {
 		http.HandleFunc("/topk", func(w http.ResponseWriter, r *http.Request) { topkHandler(w, r) })
+		http.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) { rangeHandler(w, r) })
 	}
 
 	if envhost := os.Getenv("GRAPHITEHOST") + ":" + os.Getenv("GRAPHITEPORT"); envhost != ":" || *graphiteHost != "" {
@@ -109,19 +211,19 @@ func main() {
 		graphite := g2g.NewGraphite(host, 60*time.Second, 5*time.Second)
 		hostname, _ := os.Hostname()
 		hostname = strings.Replace(hostname, ".", "_", -1)
-		namespace := fmt.Sprintf("%s.%s", graphiteNamespace, hostname)
+		namespace := fmt.Sprintf("%s.%s", *graphiteNamespace, hostname)
 		graphite.Register(namespace+".signatures", Metrics.Signatures)
 		graphite.Register(namespace+".requests", Metrics.Requests)
 	}
 
 	go func() {
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGHUP)
 
 		for range sigs {
 			log.Println("caught SIGHUP, reloading")
 
-			err := loadConfig(*input, *useStore, *storeSize, *small, *compressed, *useVPTree, *myNumber, *totalMachines)
+			err := loadConfig(opts)
 			if err != nil {
 				log.Println("reload failed: ignoring:", err)
 				break
@@ -161,35 +263,119 @@ func lineCounter(input string) (int, error) {
 	return count, nil
 }
 
-func loadConfig(input string, useStore bool, storeSize int, small bool, compressed bool, useVPTree bool, myNumber int, totalMachines int) error {
+// loadOptions holds the command line settings used to load a configuration
+type loadOptions struct {
+	input      string // signature file
+	storeFile  string // simstore to load instead of building it
+	saveFile   string // where to save the built simstore
+	mapped     bool
+	verify     bool
+	useStore   bool
+	storeSize  int
+	small      bool
+	compressed bool
+	parallel   int
+	sigBits    int
+
+	minhash      bool // build a minhash LSH index instead of a simstore
+	minhashBands int
+	minhashRows  int
+
+	useVPTree      bool
+	vptreeFile     string // vptree to load instead of building it
+	vptreeSaveFile string // where to save the built vptree
+	vptreeSeed     int64
+
+	myNumber      int
+	totalMachines int
+}
+
+func loadConfig(opts loadOptions) error {
 	var store simstore.Storage
+	var wide wideStorage
+	var mh *minhash.Index
+
+	if opts.minhash {
+		if opts.useVPTree || opts.storeFile != "" || opts.saveFile != "" || opts.small || opts.compressed || opts.sigBits != 64 {
+			return fmt.Errorf("minhash signatures support only the LSH index built from -f")
+		}
+		if opts.minhashBands < 1 || opts.minhashRows < 1 {
+			return fmt.Errorf("bad minhash index size: %d bands of %d rows", opts.minhashBands, opts.minhashRows)
+		}
+	}
+
+	if opts.sigBits != 64 {
+		if opts.useVPTree || opts.storeFile != "" || opts.saveFile != "" || opts.small || opts.compressed {
+			return fmt.Errorf("%d-bit signatures support only the uncompressed simstore built from -f", opts.sigBits)
+		}
+	}
+
+	buildStore := opts.useStore
+	if opts.useStore && opts.storeFile != "" {
+		var err error
+		store, err = readStoreFile(opts.storeFile, opts.mapped, opts.verify)
+		if err != nil {
+			return fmt.Errorf("unable to load %q: %v", opts.storeFile, err)
+		}
+		log.Println("loaded simstore from", opts.storeFile)
+		setParallelism(store, opts.parallel)
+		buildStore = false
+	}
+
+	var vpt *vptree.VPTree
+
+	buildVPTree := opts.useVPTree
+	if opts.useVPTree && opts.vptreeFile != "" {
+		var err error
+		vpt, err = readVPTreeFile(opts.vptreeFile)
+		if err != nil {
+			return fmt.Errorf("unable to load %q: %v", opts.vptreeFile, err)
+		}
+		log.Println("loaded vptree from", opts.vptreeFile)
+		buildVPTree = false
+	}
 
-	totalLines, err := lineCounter(input)
+	if !buildStore && !buildVPTree {
+		releaseConfig(UpdateConfig(&Config{store: store, vptree: vpt}))
+		return nil
+	}
+
+	totalLines, err := lineCounter(opts.input)
 	if err != nil {
-		return fmt.Errorf("unable to load %q: %v", input, err)
+		return fmt.Errorf("unable to load %q: %v", opts.input, err)
 	}
 
 	var sigsEstimate = totalLines
 
 	log.Printf("totalLines=%+v\n", totalLines)
 
-	if totalMachines != 1 {
+	if opts.totalMachines != 1 {
 		// estimate how many signatures will land on this machine, plus a fudge
-		sigsEstimate = totalLines / totalMachines
+		sigsEstimate = totalLines / opts.totalMachines
 		sigsEstimate += int(float64(sigsEstimate) * 0.05)
 	}
 
 	log.Printf("preallocating for %d estimated signatures\n", sigsEstimate)
 
 	factory := simstore.NewU64Slice
-	if compressed {
+	if opts.compressed {
 		factory = simstore.NewZStore
 	}
 
-	if useStore {
-		switch storeSize {
+	if buildStore && opts.minhash {
+		mh = minhash.NewIndex(opts.minhashBands, opts.minhashRows)
+		log.Printf("using minhash index with %d bands of %d rows", opts.minhashBands, opts.minhashRows)
+	} else if buildStore && opts.sigBits != 64 {
+		wide, err = newWideStorage(opts.sigBits, opts.storeSize, sigsEstimate)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("using %d-bit simstore size %d", opts.sigBits, opts.storeSize)
+	} else if buildStore {
+		switch opts.storeSize {
 		case 3:
-			if small {
+			if opts.small {
 				store = simstore.New3Small(sigsEstimate)
 			} else {
 				store = simstore.New3(sigsEstimate, factory)
@@ -197,17 +383,18 @@ func loadConfig(input string, useStore bool, storeSize int, small bool, compress
 		case 6:
 			store = simstore.New6(sigsEstimate, factory)
 		default:
-			return fmt.Errorf("unknown storage size: %d", storeSize)
+			if opts.storeSize < 1 || opts.storeSize > 31 {
+				return fmt.Errorf("unknown storage size: %d", opts.storeSize)
+			}
+			store = simstore.NewK(opts.storeSize, sigsEstimate, factory)
 		}
 
-		log.Println("using simstore size", storeSize)
+		log.Println("using simstore size", opts.storeSize)
 	}
 
-	var vpt *vptree.VPTree
-
-	f, err := os.Open(input)
+	f, err := os.Open(opts.input)
 	if err != nil {
-		return fmt.Errorf("unable to load %q: %v", input, err)
+		return fmt.Errorf("unable to load %q: %v", opts.input, err)
 	}
 	defer f.Close()
 
@@ -228,17 +415,38 @@ func loadConfig(input string, useStore bool, storeSize int, small bool, compress
 			continue
 		}
 
-		sig, err := strconv.ParseUint(fields[1], 16, 64)
+		// wide and minhash signatures are distributed by their last word
+		var sig uint64
+		var wsig []uint64
+		if mh != nil {
+			wsig, err = parseWideSig(fields[1], opts.minhashBands*opts.minhashRows)
+			if err == nil {
+				sig = wsig[len(wsig)-1]
+			}
+		} else if wide != nil {
+			wsig, err = parseWideSig(fields[1], wide.words())
+			if err == nil {
+				sig = wsig[len(wsig)-1]
+			}
+		} else {
+			sig, err = strconv.ParseUint(fields[1], 16, 64)
+		}
 		if err != nil {
 			log.Printf("%d: error parsing signature: %v", lines, err)
 			continue
 		}
 
-		if sig%uint64(totalMachines) == uint64(myNumber) {
-			if useVPTree {
-				items = append(items, vptree.Item{sig, uint64(id)})
+		if sig%uint64(opts.totalMachines) == uint64(opts.myNumber) {
+			if buildVPTree {
+				items = append(items, vptree.Item{Sig: sig, ID: uint64(id)})
 			}
-			if useStore {
+			if mh != nil {
+				if err := mh.Add(minhash.Signature(wsig), uint64(id)); err != nil {
+					log.Printf("%d: skipping document %d: %v", lines, id, err)
+				}
+			} else if wide != nil {
+				wide.add(wsig, uint64(id))
+			} else if buildStore {
 				store.Add(sig, uint64(id))
 			}
 			signatures++
@@ -256,20 +464,122 @@ func loadConfig(input string, useStore bool, storeSize int, small bool, compress
 
 	log.Printf("loaded %d lines, %d signatues (%f%% of estimated)", lines, signatures, 100*float64(signatures)/float64(sigsEstimate))
 	Metrics.Signatures.Set(int64(signatures))
-	if useStore {
+	if mh != nil {
+		mh.Finish()
+		log.Println("minhash index done")
+	} else if wide != nil {
+		wide.Finish()
+		log.Println("simstore done")
+	} else if buildStore {
 		store.Finish()
+		setParallelism(store, opts.parallel)
 		log.Println("simstore done")
+
+		if opts.saveFile != "" {
+			if err := writeStoreFile(opts.saveFile, store); err != nil {
+				log.Printf("unable to save simstore to %q: %v", opts.saveFile, err)
+			} else {
+				log.Println("saved simstore to", opts.saveFile)
+			}
+		}
 	}
 
-	if useVPTree {
-		vpt = vptree.New(items)
+	if buildVPTree {
+		if opts.vptreeSeed != 0 {
+			vpt = vptree.NewSeeded(items, opts.vptreeSeed)
+		} else {
+			vpt = vptree.New(items)
+		}
 		log.Println("vptree done")
+
+		if opts.vptreeSaveFile != "" {
+			if err := writeFile(opts.vptreeSaveFile, vpt); err != nil {
+				log.Printf("unable to save vptree to %q: %v", opts.vptreeSaveFile, err)
+			} else {
+				log.Println("saved vptree to", opts.vptreeSaveFile)
+			}
+		}
 	}
 
-	UpdateConfig(&Config{store: store, vptree: vpt})
+	releaseConfig(UpdateConfig(&Config{store: store, wide: wide, minhash: mh, vptree: vpt}))
 	return nil
 }
 
+func setParallelism(store simstore.Storage, n int) {
+	if m, ok := store.(*simstore.MappedStore); ok {
+		store = m.Storage
+	}
+	if p, ok := store.(interface{ SetParallelism(int) }); ok {
+		p.SetParallelism(n)
+	}
+}
+
+func readStoreFile(name string, mapped, verify bool) (simstore.Storage, error) {
+	if mapped {
+		m, err := simstore.OpenMapped(name)
+		if err != nil {
+			return nil, err
+		}
+		if verify {
+			if err := m.Verify(); err != nil {
+				m.Close()
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return simstore.ReadStore(f)
+}
+
+func writeStoreFile(name string, store simstore.Storage) error {
+	wt, ok := store.(io.WriterTo)
+	if !ok {
+		return fmt.Errorf("store does not support saving")
+	}
+
+	return writeFile(name, wt)
+}
+
+func readVPTreeFile(name string) (*vptree.VPTree, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return vptree.Read(f)
+}
+
+// writeFile writes wt to a temporary file and renames it into place, so a
+// running simd never sees a partial file
+func writeFile(name string, wt io.WriterTo) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := wt.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
 func topkHandler(w http.ResponseWriter, r *http.Request) {
 
 	Metrics.Requests.Add(1)
@@ -292,9 +602,54 @@ func topkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vpt := CurrentConfig().vptree
+	maxd := 64
+	if dstr := r.FormValue("maxd"); dstr != "" {
+		maxd, err = strconv.Atoi(dstr)
+		if err != nil || maxd < 0 {
+			http.Error(w, "bad distance: "+dstr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg := acquireConfig()
+	defer releaseConfig(cfg)
+	vpt := cfg.vptree
+
+	matches, distances := vpt.SearchBounded(sig64, k, maxd)
 
-	matches, distances := vpt.Search(sig64, k)
+	writeHits(w, matches, distances)
+}
+
+// rangeHandler returns every document within distance r of the signature,
+// found with the vptree
+func rangeHandler(w http.ResponseWriter, r *http.Request) {
+
+	Metrics.Requests.Add(1)
+
+	sigstr := r.FormValue("sig")
+	sig64, err := strconv.ParseUint(sigstr, 16, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rstr := r.FormValue("r")
+	radius, err := strconv.Atoi(rstr)
+	if err != nil || radius < 0 {
+		http.Error(w, "bad radius: "+rstr, http.StatusBadRequest)
+		return
+	}
+
+	cfg := acquireConfig()
+	defer releaseConfig(cfg)
+	vpt := cfg.vptree
+
+	matches, distances := vpt.SearchRadius(sig64, radius)
+
+	writeHits(w, matches, distances)
+}
+
+func writeHits(w http.ResponseWriter, matches []vptree.Item, distances []float64) {
 
 	type hit struct {
 		ID uint64  `json:"id"`
@@ -316,18 +671,144 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 	sigstr := r.FormValue("sig")
 
-	var sig64 uint64
+	// optional distance threshold; the stores treat anything above their k as k
+	d := math.MaxInt32
+	if dstr := r.FormValue("d"); dstr != "" {
+		var err error
+		d, err = strconv.Atoi(dstr)
+		if err != nil || d < 0 {
+			http.Error(w, "bad distance: "+dstr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	type hit struct {
+		ID  uint64 `json:"id"`
+		Sig string `json:"sig"`
+		D   int    `json:"d"`
+	}
+
+	results := []hit{}
+
+	cfg := acquireConfig()
+	defer releaseConfig(cfg)
+
+	if cfg.minhash != nil {
+		minhashSearch(w, cfg.minhash, sigstr)
+		return
+	}
+
+	if cfg.wide != nil {
+		sig, err := parseWideSig(sigstr, cfg.wide.words())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, m := range cfg.wide.findMatches(sig, d) {
+			results = append(results, hit{ID: m.docid, Sig: formatWideSig(m.sig), D: m.distance})
+		}
+
+		json.NewEncoder(w).Encode(results)
+		return
+	}
 
-	var err error
-	sig64, err = strconv.ParseUint(sigstr, 16, 64)
+	sig64, err := strconv.ParseUint(sigstr, 16, 64)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	store := CurrentConfig().store
+	matches := cfg.store.FindMatchesWithin(sig64, d)
+	cfg.checkStore()
+
+	for _, m := range matches {
+		results = append(results, hit{ID: m.DocID, Sig: fmt.Sprintf("%016x", m.Sig), D: m.Distance})
+	}
 
-	matches := store.Find(sig64)
+	json.NewEncoder(w).Encode(results)
+}
+
+// batchHandler searches for many signatures at once.  The POST body is either
+// a JSON array of hex signatures or one hex signature per line.  The response
+// is a JSON array holding the document ids found for each signature.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "batch search requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	Metrics.Requests.Add(1)
+
+	body := bufio.NewReader(r.Body)
+
+	var sigstrs []string
+
+	if b, err := body.Peek(1); err == nil && b[0] == '[' {
+		if err := json.NewDecoder(body).Decode(&sigstrs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				sigstrs = append(sigstrs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cfg := acquireConfig()
+	defer releaseConfig(cfg)
+
+	if cfg.minhash != nil || cfg.wide != nil {
+		matches := make([][]uint64, len(sigstrs))
+		for i, sigstr := range sigstrs {
+			var err error
+			if cfg.minhash != nil {
+				matches[i], err = minhashFind(cfg.minhash, sigstr)
+			} else {
+				var sig []uint64
+				if sig, err = parseWideSig(sigstr, cfg.wide.words()); err == nil {
+					matches[i] = cfg.wide.find(sig)
+				}
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if matches[i] == nil {
+				matches[i] = []uint64{}
+			}
+		}
+
+		json.NewEncoder(w).Encode(matches)
+		return
+	}
+
+	sigs := make([]uint64, len(sigstrs))
+	for i, sigstr := range sigstrs {
+		var err error
+		sigs[i], err = strconv.ParseUint(sigstr, 16, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	matches := cfg.store.FindBatch(sigs)
+	cfg.checkStore()
+
+	for i := range matches {
+		if matches[i] == nil {
+			matches[i] = []uint64{}
+		}
+	}
 
 	json.NewEncoder(w).Encode(matches)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgryski/go-simstore/minhash"
+)
+
+// minhashSearch writes the documents in the index similar to the minhash
+// signature sigstr, most similar first
+func minhashSearch(w http.ResponseWriter, index *minhash.Index, sigstr string) {
+	sig, err := parseWideSig(sigstr, index.SignatureLen())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	type hit struct {
+		ID  uint64  `json:"id"`
+		Sim float64 `json:"sim"`
+	}
+
+	results := []hit{}
+
+	for _, m := range index.FindMatches(minhash.Signature(sig)) {
+		results = append(results, hit{ID: m.DocID, Sim: m.Similarity})
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+func minhashFind(index *minhash.Index, sigstr string) ([]uint64, error) {
+	sig, err := parseWideSig(sigstr, index.SignatureLen())
+	if err != nil {
+		return nil, err
+	}
+	return index.Find(minhash.Signature(sig)), nil
+}
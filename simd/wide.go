@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dgryski/go-simstore"
+)
+
+// wideStorage adapts Store128 and Store256 to signatures parsed into words
+type wideStorage interface {
+	words() int
+	add(sig []uint64, docid uint64)
+	Finish()
+	find(sig []uint64) []uint64
+	findMatches(sig []uint64, d int) []wideMatch
+}
+
+type wideMatch struct {
+	docid    uint64
+	sig      []uint64
+	distance int
+}
+
+func newWideStorage(bits, k, hashes int) (wideStorage, error) {
+	if bits != 128 && bits != 256 {
+		return nil, fmt.Errorf("unsupported signature size: %d bits", bits)
+	}
+
+	if k < 1 || 2*(k+1) > bits {
+		return nil, fmt.Errorf("unknown storage size %d for %d-bit signatures", k, bits)
+	}
+
+	if bits == 128 {
+		return store128{simstore.New128(k, hashes)}, nil
+	}
+
+	return store256{simstore.New256(k, hashes)}, nil
+}
+
+type store128 struct{ *simstore.Store128 }
+
+func (s store128) words() int                     { return 2 }
+func (s store128) add(sig []uint64, docid uint64) { s.Add([2]uint64{sig[0], sig[1]}, docid) }
+func (s store128) find(sig []uint64) []uint64     { return s.Find([2]uint64{sig[0], sig[1]}) }
+
+func (s store128) findMatches(sig []uint64, d int) []wideMatch {
+	var m []wideMatch
+	for _, v := range s.FindMatchesWithin([2]uint64{sig[0], sig[1]}, d) {
+		sig := v.Sig
+		m = append(m, wideMatch{docid: v.DocID, sig: sig[:], distance: v.Distance})
+	}
+	return m
+}
+
+type store256 struct{ *simstore.Store256 }
+
+func (s store256) words() int { return 4 }
+
+func (s store256) add(sig []uint64, docid uint64) {
+	s.Add([4]uint64{sig[0], sig[1], sig[2], sig[3]}, docid)
+}
+
+func (s store256) find(sig []uint64) []uint64 {
+	return s.Find([4]uint64{sig[0], sig[1], sig[2], sig[3]})
+}
+
+func (s store256) findMatches(sig []uint64, d int) []wideMatch {
+	var m []wideMatch
+	for _, v := range s.FindMatchesWithin([4]uint64{sig[0], sig[1], sig[2], sig[3]}, d) {
+		sig := v.Sig
+		m = append(m, wideMatch{docid: v.DocID, sig: sig[:], distance: v.Distance})
+	}
+	return m
+}
+
+// parseWideSig parses a signature of the given number of 64-bit words, written
+// as 16 hex characters per word with the most significant word first
+func parseWideSig(s string, words int) ([]uint64, error) {
+	if len(s) != 16*words {
+		return nil, fmt.Errorf("signature %q must be %d hex characters", s, 16*words)
+	}
+
+	sig := make([]uint64, words)
+	for i := range sig {
+		var err error
+		sig[i], err = strconv.ParseUint(s[16*i:16*(i+1)], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
+
+func formatWideSig(sig []uint64) string {
+	var b strings.Builder
+	for _, v := range sig {
+		fmt.Fprintf(&b, "%016x", v)
+	}
+	return b.String()
+}
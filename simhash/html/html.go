@@ -0,0 +1,267 @@
+// Package html extracts the visible text of HTML documents for simhash.
+/*
+The Scanner drops markup, comments, scripts and styles, so that changes to a
+site's templates have little effect on the signature of a page.  Text inside
+the title and heading elements can be given a higher weight for use with
+simhash.HashWeighted.
+*/
+package html
+
+import (
+	"bytes"
+	stdhtml "html"
+	"io"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+// Options configure a Scanner.  The zero value returns single words with
+// weight 1.
+type Options struct {
+	// Shingle is the number of words in each feature; 0 means 1
+	Shingle int
+
+	// Title is the weight of text in the <title> element; 0 means 1
+	Title float64
+
+	// Heading is the weight of text in the <h1> to <h6> elements; 0 means 1
+	Heading float64
+}
+
+// Scanner returns the lower-cased words, or word shingles, of the visible
+// text of an HTML document.  It implements simhash.WeightedFeatureScanner.
+type Scanner struct {
+	r    io.Reader
+	opts Options
+	err  error
+
+	words   [][]byte
+	weights []float64
+	loaded  bool
+
+	i      int
+	token  []byte
+	weight float64
+}
+
+// NewScanner creates a scanner for the HTML document read from r.  opts may
+// be nil.
+func NewScanner(r io.Reader, opts *Options) *Scanner {
+	s := &Scanner{r: r}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.Shingle < 1 {
+		s.opts.Shingle = 1
+	}
+	if s.opts.Title == 0 {
+		s.opts.Title = 1
+	}
+	if s.opts.Heading == 0 {
+		s.opts.Heading = 1
+	}
+	return s
+}
+
+func (s *Scanner) Scan() bool {
+
+	if !s.loaded {
+		s.loaded = true
+		var doc []byte
+		doc, s.err = io.ReadAll(s.r)
+		if s.err != nil {
+			return false
+		}
+		s.parse(doc)
+	}
+
+	n := s.opts.Shingle
+	if s.i >= len(s.words) || (s.i > 0 && s.i+n > len(s.words)) {
+		return false
+	}
+
+	end := s.i + n
+	if end > len(s.words) {
+		// a document shorter than one shingle
+		end = len(s.words)
+	}
+
+	s.token = s.token[:0]
+	s.weight = 0
+	for j := s.i; j < end; j++ {
+		if j > s.i {
+			s.token = append(s.token, ' ')
+		}
+		s.token = append(s.token, s.words[j]...)
+		if s.weights[j] > s.weight {
+			s.weight = s.weights[j]
+		}
+	}
+
+	s.i++
+	return true
+}
+
+func (s *Scanner) Bytes() []byte { return s.token }
+
+// Weight returns the weight of the current feature: the highest weight of
+// its words
+func (s *Scanner) Weight() float64 { return s.weight }
+
+func (s *Scanner) Err() error { return s.err }
+
+// parse collects the words of the visible text of doc and their weights
+func (s *Scanner) parse(doc []byte) {
+
+	var title, heading int
+
+	for len(doc) > 0 {
+		i := bytes.IndexByte(doc, '<')
+		if i < 0 {
+			i = len(doc)
+		}
+
+		weight := float64(1)
+		if title > 0 && s.opts.Title > weight {
+			weight = s.opts.Title
+		}
+		if heading > 0 && s.opts.Heading > weight {
+			weight = s.opts.Heading
+		}
+		s.addText(doc[:i], weight)
+		doc = doc[i:]
+
+		if len(doc) == 0 {
+			break
+		}
+
+		if len(doc) < 2 || !(isASCIILetter(doc[1]) || doc[1] == '/' || doc[1] == '!' || doc[1] == '?') {
+			// a literal '<' in the text
+			doc = doc[1:]
+			continue
+		}
+
+		if bytes.HasPrefix(doc, []byte("<!--")) {
+			doc = skipPast(doc, []byte("-->"))
+			continue
+		}
+
+		name, end, closing := parseTag(doc)
+		doc = doc[end:]
+
+		switch name {
+		case "script", "style":
+			if !closing {
+				doc = skipElement(doc, name)
+			}
+		case "title":
+			title = count(title, closing)
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			heading = count(heading, closing)
+		}
+	}
+}
+
+func count(depth int, closing bool) int {
+	if !closing {
+		return depth + 1
+	}
+	if depth > 0 {
+		return depth - 1
+	}
+	return 0
+}
+
+// addText splits the text between tags into words
+func (s *Scanner) addText(text []byte, weight float64) {
+	if len(text) == 0 {
+		return
+	}
+
+	text = []byte(stdhtml.UnescapeString(string(text)))
+
+	for len(text) > 0 {
+		advance, token, _ := simhash.ScanUnicodeWords(text, true)
+		if advance == 0 {
+			break
+		}
+		text = text[advance:]
+
+		if r, _ := utf8.DecodeRune(token); !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			// punctuation
+			continue
+		}
+
+		s.words = append(s.words, bytes.ToLower(token))
+		s.weights = append(s.weights, weight)
+	}
+}
+
+// parseTag parses the tag at the start of doc, returning its lower-cased
+// name, its length and whether it is a closing tag.  Declarations such as
+// <!DOCTYPE> have no name.
+func parseTag(doc []byte) (name string, end int, closing bool) {
+
+	i := 1
+	if i < len(doc) && doc[i] == '/' {
+		closing = true
+		i++
+	}
+
+	start := i
+	for i < len(doc) && (isASCIILetter(doc[i]) || (i > start && doc[i] >= '0' && doc[i] <= '9')) {
+		i++
+	}
+	name = string(bytes.ToLower(doc[start:i]))
+
+	// find the end of the tag, skipping quoted attribute values
+	var quote byte
+	for ; i < len(doc); i++ {
+		switch c := doc[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return name, i + 1, closing
+		}
+	}
+
+	return name, len(doc), closing
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// skipPast returns doc following the first occurrence of sep, or nothing
+func skipPast(doc, sep []byte) []byte {
+	i := bytes.Index(doc, sep)
+	if i < 0 {
+		return nil
+	}
+	return doc[i+len(sep):]
+}
+
+// skipElement returns doc following the closing tag of the raw text element
+// name, such as </script>
+func skipElement(doc []byte, name string) []byte {
+	closing := []byte("</" + name)
+	for {
+		i := bytes.Index(doc, []byte("</"))
+		if i < 0 {
+			return nil
+		}
+		doc = doc[i:]
+		if len(doc) >= len(closing) && bytes.EqualFold(doc[:len(closing)], closing) &&
+			(len(doc) == len(closing) || !isASCIILetter(doc[len(closing)])) {
+			_, end, _ := parseTag(doc)
+			return doc[end:]
+		}
+		doc = doc[2:]
+	}
+}
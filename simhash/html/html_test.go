@@ -0,0 +1,130 @@
+package html
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/go-simstore/simhash"
+)
+
+func words(s *Scanner) []string {
+	var w []string
+	for s.Scan() {
+		w = append(w, string(s.Bytes()))
+	}
+	return w
+}
+
+func TestScanner(t *testing.T) {
+
+	doc := `<!DOCTYPE html>
+<html><head><title>The Title</title>
+<style>body { color: red }</style>
+<script type="text/javascript">var x = "</div>"; if (a < b) {}</script>
+</head>
+<body class="main">
+<!-- a comment <p>hidden</p> -->
+<h1 id='top'>Big &amp; Bold</h1>
+<p>Fish &lt; chips, isn't it? <a href="/x?a=1&b=2" title="a > b">Click</a></p>
+<SCRIPT>hidden()</SCRIPT>
+</body></html>`
+
+	want := []string{"the", "title", "big", "bold", "fish", "chips", "isn't", "it", "click"}
+	if got := words(NewScanner(strings.NewReader(doc), nil)); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewScanner()=%q, want %q", got, want)
+	}
+
+	s := NewScanner(strings.NewReader(doc), &Options{Shingle: 3, Title: 4, Heading: 2})
+	var got []string
+	for s.Scan() {
+		got = append(got, fmt.Sprintf("%s:%v", s.Bytes(), s.Weight()))
+	}
+	want = []string{"the title big:4", "title big bold:4", "big bold fish:2", "bold fish chips:2", "fish chips isn't:1", "chips isn't it:1", "isn't it click:1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shingles=%q, want %q", got, want)
+	}
+}
+
+const article = `It was the best of times, it was the worst of times, it was the age of
+wisdom, it was the age of foolishness, it was the epoch of belief, it was the
+epoch of incredulity, it was the season of Light, it was the season of
+Darkness, it was the spring of hope, it was the winter of despair, we had
+everything before us, we had nothing before us, we were all going direct to
+Heaven, we were all going direct the other way.`
+
+const other = `Call me Ishmael. Some years ago, never mind how long precisely, having
+little or no money in my purse, and nothing particular to interest me on
+shore, I thought I would sail about a little and see the watery part of the
+world. It is a way I have of driving off the spleen and regulating the
+circulation.`
+
+func page(template int, text string) string {
+	switch template {
+	case 0:
+		return `<html><head><title>A Tale</title><link rel="stylesheet" href="/a.css"></head>
+<body><div class="nav"><a href="/">Home</a> <a href="/books">Books</a></div>
+<div class="content"><p>` + text + `</p></div>
+<div class="footer">Copyright 2015</div></body></html>`
+	default:
+		return `<!DOCTYPE html><html><head><title>A Tale</title>
+<script src="/analytics.js"></script><script>track({page: "tale", id: 42});</script>
+<style>.content { margin: 0 auto; width: 60em; }</style></head>
+<body><nav id="menu"><ul><li><a class="home" href="/index.html">Home</a></li>
+<li><a href="/books/">Books</a></li><li><a href="/authors/">Authors</a></li></ul></nav>
+<main><article class="story" data-id="42"><section><p>` + text + `</p></section></article></main>
+<footer><small>Copyright 2016</small></footer></body></html>`
+	}
+}
+
+func TestTemplateChanges(t *testing.T) {
+
+	hash := func(doc string) uint64 {
+		return simhash.Hash(NewScanner(strings.NewReader(doc), &Options{Shingle: 2}))
+	}
+
+	raw := func(doc string) uint64 {
+		return simhash.Hash(simhash.NewByteShingler(strings.NewReader(doc), 3, 0))
+	}
+
+	template := simhash.Distance(hash(page(0, article)), hash(page(1, article)))
+	content := simhash.Distance(hash(page(0, article)), hash(page(0, other)))
+	rawTemplate := simhash.Distance(raw(page(0, article)), raw(page(1, article)))
+
+	t.Logf("template change: %d, raw markup: %d, content change: %d", template, rawTemplate, content)
+
+	if template > 6 {
+		t.Errorf("template change: distance %d, want <= 6", template)
+	}
+
+	if template >= rawTemplate {
+		t.Errorf("template change: distance %d, no better than raw markup %d", template, rawTemplate)
+	}
+
+	if content <= 3*template {
+		t.Errorf("content change: distance %d, template change %d", content, template)
+	}
+}
+
+func TestWeights(t *testing.T) {
+
+	// an odd number of title words can't cancel out on any bit
+	doc := `<html><head><title>Unique Heading Words</title></head><body><p>` + article + `</p></body></html>`
+	title := simhash.Hash(NewScanner(strings.NewReader("Unique Heading Words"), nil))
+
+	plain := simhash.HashWeighted(NewScanner(strings.NewReader(doc), nil))
+	weighted := simhash.HashWeighted(NewScanner(strings.NewReader(doc), &Options{Title: 1000}))
+
+	if plain != simhash.Hash(NewScanner(strings.NewReader(doc), nil)) {
+		t.Errorf("unit weights: HashWeighted differs from Hash")
+	}
+
+	if d := simhash.Distance(weighted, title); d != 0 {
+		t.Errorf("heavily weighted title: distance to title %d, want 0", d)
+	}
+
+	if simhash.Distance(plain, title) == 0 {
+		t.Errorf("unweighted: distance to title 0")
+	}
+}
@@ -0,0 +1,157 @@
+package simhash
+
+import (
+	"bytes"
+	"io"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Norm selects the normalisations applied by a normalising scanner or reader
+type Norm int
+
+const (
+	// NormUnicode applies Unicode NFKC normalisation, so that composed and
+	// decomposed characters, and full-width and half-width forms, are the same
+	NormUnicode Norm = 1 << iota
+
+	// NormQuotes replaces typographic quotes and dashes with their ASCII forms
+	NormQuotes
+
+	// NormCase applies Unicode case folding
+	NormCase
+
+	// NormSpace collapses each run of whitespace to a single space
+	NormSpace
+
+	NormAll = NormUnicode | NormQuotes | NormCase | NormSpace
+)
+
+// newNormalizer returns a transformer applying the normalisations in flags
+func newNormalizer(flags Norm) transform.Transformer {
+	var t []transform.Transformer
+
+	if flags&NormUnicode != 0 {
+		t = append(t, norm.NFKC)
+	}
+	if flags&NormQuotes != 0 {
+		t = append(t, runes.Map(asciiQuote))
+	}
+	if flags&NormCase != 0 {
+		t = append(t, cases.Fold())
+	}
+	if flags&NormSpace != 0 {
+		t = append(t, &spaceCollapser{})
+	}
+
+	return transform.Chain(t...)
+}
+
+func asciiQuote(r rune) rune {
+	switch r {
+	case '‘', '’', '‚', '‛', '′':
+		return '\''
+	case '“', '”', '„', '‟', '″':
+		return '"'
+	case '‐', '‑', '‒', '–', '—', '―', '−':
+		return '-'
+	}
+	return r
+}
+
+// spaceCollapser replaces each run of whitespace with a single space
+type spaceCollapser struct {
+	space bool
+}
+
+func (t *spaceCollapser) Reset() { t.space = false }
+
+func (t *spaceCollapser) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+
+		r, size := utf8.DecodeRune(src[nSrc:])
+		if unicode.IsSpace(r) {
+			if !t.space {
+				if nDst >= len(dst) {
+					return nDst, nSrc, transform.ErrShortDst
+				}
+				dst[nDst] = ' '
+				nDst++
+				t.space = true
+			}
+			nSrc += size
+			continue
+		}
+
+		if nDst+size > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], src[nSrc:nSrc+size])
+		nSrc += size
+		t.space = false
+	}
+
+	return nDst, nSrc, nil
+}
+
+// NewNormalizingReader returns a reader which normalises the text read from r.
+// Use it ahead of a bufio.Scanner or shingler, so that n-grams are taken from
+// the normalised text.
+func NewNormalizingReader(r io.Reader, flags Norm) io.Reader {
+	return transform.NewReader(r, newNormalizer(flags))
+}
+
+type normScanner struct {
+	s     FeatureScanner
+	t     transform.Transformer
+	flags Norm
+	token []byte
+	err   error
+}
+
+// NewNormalizingScanner wraps the scanner s, normalising each of its features.
+// With NormSpace the features are also trimmed, and features left empty are
+// skipped.
+func NewNormalizingScanner(s FeatureScanner, flags Norm) FeatureScanner {
+	return &normScanner{s: s, t: newNormalizer(flags), flags: flags}
+}
+
+func (s *normScanner) Scan() bool {
+	for s.s.Scan() {
+		var err error
+		s.token, _, err = transform.Append(s.t, s.token[:0], s.s.Bytes())
+		if err != nil {
+			s.err = err
+			return false
+		}
+
+		if s.flags&NormSpace != 0 {
+			s.token = bytes.TrimSpace(s.token)
+			if len(s.token) == 0 {
+				continue
+			}
+		}
+
+		return true
+	}
+	return false
+}
+
+func (s *normScanner) Bytes() []byte {
+	return s.token
+}
+
+func (s *normScanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.s.Err()
+}
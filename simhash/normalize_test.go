@@ -0,0 +1,74 @@
+package simhash
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizingReader(t *testing.T) {
+
+	tests := []struct {
+		in    string
+		flags Norm
+		want  string
+	}{
+		{"café", NormUnicode, "café"},
+		{"ｆｕｌｌ　ｗｉｄｔｈ", NormUnicode, "full width"},
+		{"“smart” ‘quotes’ — dash", NormQuotes, "\"smart\" 'quotes' - dash"},
+		{"Straße MIXED", NormCase, "strasse mixed"},
+		{"a \t\n  b\n\nc", NormSpace, "a b c"},
+		{"  Ｃａｆｅ́  “Ｏｋ” ", NormAll, " café \"ok\" "},
+	}
+
+	for _, tt := range tests {
+		got, err := io.ReadAll(NewNormalizingReader(strings.NewReader(tt.in), tt.flags))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("NewNormalizingReader(%q, %d)=%q (%v), want %q", tt.in, tt.flags, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizingScanner(t *testing.T) {
+
+	tokens := [][]byte{[]byte("Café"), []byte("  "), []byte("ＷＩＤＥ  text"), []byte("it’s")}
+
+	var got []string
+	s := NewNormalizingScanner(NewSliceScanner(tokens), NormAll)
+	for s.Scan() {
+		got = append(got, string(s.Bytes()))
+	}
+
+	if want := []string{"café", "wide text", "it's"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NewNormalizingScanner=%q, want %q", got, want)
+	}
+
+	// composes with bufio.Scanner
+	b := bufio.NewScanner(strings.NewReader("Ｎｏｗ is THE winter"))
+	b.Split(bufio.ScanWords)
+	if got, want := Hash(NewNormalizingScanner(b, NormAll)), Hash(NewSliceScanner([][]byte{[]byte("now"), []byte("is"), []byte("the"), []byte("winter")})); got != want {
+		t.Errorf("normalised bufio.Scanner=%016x, want %016x", got, want)
+	}
+}
+
+func TestNormalizedTrigrams(t *testing.T) {
+
+	nfc := "Le café “Chez Zoë” est fermé — désolé"
+	nfd := "Le café \"Chez Zoë\"   est fermé - désolé"
+
+	hash := func(s string) uint64 {
+		scanner := bufio.NewScanner(NewNormalizingReader(strings.NewReader(s), NormAll))
+		scanner.Split(ScanByteTrigrams)
+		return Hash(scanner)
+	}
+
+	if d := Distance(simhashString(nfc), simhashString(nfd)); d == 0 {
+		t.Errorf("unnormalised: distance 0")
+	}
+
+	if got, want := hash(nfd), hash(nfc); got != want {
+		t.Errorf("normalised=%016x, want %016x", got, want)
+	}
+}
@@ -1,7 +1,12 @@
 package simhash
 
-// TODO(dgryski): channel scanner
-// TODO(dgryski): ngram scanner for bytes and words
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode"
+	"unicode/utf8"
+)
 
 // Return features one-at-a-time to be considered by SimHash.
 // This matches (partially) the scanner interface for bufio.Scanner, so those scanner can be reused here.
@@ -38,6 +43,28 @@ func (s *SliceScanner) Bytes() []byte {
 	return s.tokens[s.i-1]
 }
 
+// WeightedFeatureScanner returns features along with their weights, such as
+// TF-IDF scores or the importance of the enclosing HTML tag
+type WeightedFeatureScanner interface {
+	FeatureScanner
+	Weight() float64
+}
+
+type WeightedSliceScanner struct {
+	SliceScanner
+	weights []float64
+}
+
+// NewWeightedSliceScanner creates a scanner that returns the byte slices in
+// tokens with the corresponding weights
+func NewWeightedSliceScanner(tokens [][]byte, weights []float64) WeightedFeatureScanner {
+	return &WeightedSliceScanner{SliceScanner: SliceScanner{tokens: tokens}, weights: weights}
+}
+
+func (s *WeightedSliceScanner) Weight() float64 {
+	return s.weights[s.i-1]
+}
+
 func ScanByteTrigrams(data []byte, atEOF bool) (advance int, token []byte, err error) {
 
 	if atEOF || len(data) < 3 {
@@ -46,3 +73,248 @@ func ScanByteTrigrams(data []byte, atEOF bool) (advance int, token []byte, err e
 
 	return 1, data[:3], nil
 }
+
+// ScanByteNgrams returns a split function for a bufio.Scanner which returns
+// the overlapping n-byte substrings of the input, as ScanByteTrigrams does for n=3
+func ScanByteNgrams(n int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+		if atEOF || len(data) < n {
+			return 0, nil, nil
+		}
+
+		return 1, data[:n], nil
+	}
+}
+
+// ScanUnicodeWords is a split function for a bufio.Scanner which returns the
+// words of the input.  A word is a run of letters, marks and digits, which may
+// be joined by an apostrophe or full stop as in "we'll" or "3.14".  Each other
+// non-space character is returned as a token of its own.
+func ScanUnicodeWords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+
+	// skip leading spaces
+	start := 0
+	for start < len(data) {
+		if !atEOF && !utf8.FullRune(data[start:]) {
+			return start, nil, nil
+		}
+		r, w := utf8.DecodeRune(data[start:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		start += w
+	}
+
+	if start == len(data) {
+		return start, nil, nil
+	}
+
+	r, w := utf8.DecodeRune(data[start:])
+	if !isWordRune(r) {
+		return start + w, data[start : start+w], nil
+	}
+
+	i := start + w
+	for i < len(data) {
+		if !atEOF && !utf8.FullRune(data[i:]) {
+			return start, nil, nil
+		}
+		r, w := utf8.DecodeRune(data[i:])
+		if isWordRune(r) {
+			i += w
+			continue
+		}
+		if r == '\'' || r == '\u2019' || r == '.' {
+			// only joins a word if another word character follows
+			j := i + w
+			if j == len(data) || !utf8.FullRune(data[j:]) {
+				if !atEOF {
+					return start, nil, nil
+				}
+				break
+			}
+			if r2, _ := utf8.DecodeRune(data[j:]); isWordRune(r2) {
+				i = j
+				continue
+			}
+		}
+		break
+	}
+
+	if i == len(data) && !atEOF {
+		// the word may continue
+		return start, nil, nil
+	}
+
+	return i, data[start:i], nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// ShingleFlags control how text is normalised before shingling
+type ShingleFlags int
+
+const (
+	// FoldCase lower-cases the text
+	FoldCase ShingleFlags = 1 << iota
+
+	// StripPunct drops punctuation characters
+	StripPunct
+)
+
+type shingleScanner struct {
+	s       *bufio.Scanner
+	n       int
+	words   bool
+	flags   ShingleFlags
+	emitted bool
+
+	buf    []byte   // byte shingles: the bytes of the current window
+	window [][]byte // word shingles: the words of the current window
+	token  []byte
+}
+
+// NewByteShingler creates a scanner that returns the overlapping n-byte
+// shingles of the text read from r.  A text shorter than n bytes is returned
+// as a single shingle.
+func NewByteShingler(r io.Reader, n int, flags ShingleFlags) FeatureScanner {
+	s := &shingleScanner{s: bufio.NewScanner(r), n: n, flags: flags}
+	if flags == 0 {
+		s.s.Split(bufio.ScanBytes)
+	} else {
+		s.s.Split(bufio.ScanRunes)
+	}
+	return s
+}
+
+// NewWordShingler creates a scanner that returns the overlapping n-word
+// shingles of the text read from r, split by ScanUnicodeWords and joined by
+// single spaces.  A text shorter than n words is returned as a single shingle.
+func NewWordShingler(r io.Reader, n int, flags ShingleFlags) FeatureScanner {
+	s := &shingleScanner{s: bufio.NewScanner(r), n: n, words: true, flags: flags}
+	s.s.Split(ScanUnicodeWords)
+	return s
+}
+
+// next returns the next normalised token from the underlying scanner
+func (s *shingleScanner) next() ([]byte, bool) {
+	for s.s.Scan() {
+		u := s.s.Bytes()
+		if s.flags&StripPunct != 0 {
+			u = bytes.Map(stripPunct, u)
+		}
+		if s.flags&FoldCase != 0 {
+			u = bytes.ToLower(u)
+		}
+		if len(u) > 0 {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func stripPunct(r rune) rune {
+	if unicode.IsPunct(r) {
+		return -1
+	}
+	return r
+}
+
+func (s *shingleScanner) len() int {
+	if s.words {
+		return len(s.window)
+	}
+	return len(s.buf)
+}
+
+func (s *shingleScanner) Scan() bool {
+
+	// after the first shingle, the window slides by one
+	want := s.n
+	if s.emitted {
+		want++
+	}
+
+	for s.len() < want {
+		u, ok := s.next()
+		if !ok {
+			break
+		}
+		if s.words {
+			s.window = append(s.window, append([]byte(nil), u...))
+		} else {
+			s.buf = append(s.buf, u...)
+		}
+	}
+
+	if s.emitted {
+		if s.len() < want {
+			return false
+		}
+		if s.words {
+			s.window = s.window[1:]
+		} else {
+			s.buf = s.buf[1:]
+		}
+	} else if s.len() == 0 {
+		return false
+	}
+
+	s.emitted = true
+
+	if !s.words {
+		s.token = s.buf
+		if len(s.token) > s.n {
+			s.token = s.token[:s.n]
+		}
+		return true
+	}
+
+	s.token = s.token[:0]
+	for i, w := range s.window {
+		if i == s.n {
+			break
+		}
+		if i > 0 {
+			s.token = append(s.token, ' ')
+		}
+		s.token = append(s.token, w...)
+	}
+	return true
+}
+
+func (s *shingleScanner) Bytes() []byte {
+	return s.token
+}
+
+func (s *shingleScanner) Err() error {
+	return s.s.Err()
+}
+
+// ChannelScanner returns the features received from a channel until it is closed
+type ChannelScanner struct {
+	c <-chan []byte
+	b []byte
+}
+
+// NewChannelScanner creates a scanner that returns the byte slices received from c
+func NewChannelScanner(c <-chan []byte) FeatureScanner {
+	return &ChannelScanner{c: c}
+}
+
+func (s *ChannelScanner) Err() error {
+	return nil
+}
+
+func (s *ChannelScanner) Scan() bool {
+	b, ok := <-s.c
+	s.b = b
+	return ok
+}
+
+func (s *ChannelScanner) Bytes() []byte {
+	return s.b
+}
@@ -0,0 +1,88 @@
+package simhash
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func scanAll(s FeatureScanner) []string {
+	var tokens []string
+	for s.Scan() {
+		tokens = append(tokens, string(s.Bytes()))
+	}
+	return tokens
+}
+
+func TestScanUnicodeWords(t *testing.T) {
+
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"hello, world", []string{"hello", ",", "world"}},
+		{"We'll pay 3.14 for crème brûlée.", []string{"We'll", "pay", "3.14", "for", "crème", "brûlée", "."}},
+		{"Grüße aus Köln!", []string{"Grüße", "aus", "Köln", "!"}},
+		{"'quoted'", []string{"'", "quoted", "'"}},
+		{"東京 タワー", []string{"東京", "タワー"}},
+	}
+
+	for _, tt := range tests {
+		s := bufio.NewScanner(strings.NewReader(tt.in))
+		s.Buffer(make([]byte, 4), 64)
+		s.Split(ScanUnicodeWords)
+		if got := scanAll(s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ScanUnicodeWords(%q)=%q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestShinglers(t *testing.T) {
+
+	tests := []struct {
+		name string
+		s    FeatureScanner
+		want []string
+	}{
+		{"bytes", NewByteShingler(strings.NewReader("abcde"), 3, 0), []string{"abc", "bcd", "cde"}},
+		{"short bytes", NewByteShingler(strings.NewReader("ab"), 3, 0), []string{"ab"}},
+		{"empty", NewByteShingler(strings.NewReader(""), 3, 0), nil},
+		{"folded bytes", NewByteShingler(strings.NewReader("A.bC"), 2, FoldCase|StripPunct), []string{"ab", "bc"}},
+		{"words", NewWordShingler(strings.NewReader("the quick brown fox"), 2, 0), []string{"the quick", "quick brown", "brown fox"}},
+		{"punct words", NewWordShingler(strings.NewReader("Hi, Bob."), 2, 0), []string{"Hi ,", ", Bob", "Bob ."}},
+		{"stripped words", NewWordShingler(strings.NewReader("Hi, Bob. We'll go!"), 3, FoldCase|StripPunct), []string{"hi bob well", "bob well go"}},
+		{"short words", NewWordShingler(strings.NewReader("one two"), 3, 0), []string{"one two"}},
+	}
+
+	for _, tt := range tests {
+		if got := scanAll(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// the byte shingler matches ScanByteTrigrams
+	const text = "Now is the winter of our discontent"
+	if got, want := Hash(NewByteShingler(strings.NewReader(text), 3, 0)), simhashString(text); got != want {
+		t.Errorf("NewByteShingler(3)=%016x, want %016x", got, want)
+	}
+}
+
+func TestChannelScanner(t *testing.T) {
+
+	tokens := [][]byte{[]byte("now"), []byte("is"), []byte("the"), []byte("winter")}
+
+	c := make(chan []byte)
+	go func() {
+		for _, tok := range tokens {
+			c <- tok
+		}
+		close(c)
+	}()
+
+	if got, want := Hash(NewChannelScanner(c)), Hash(NewSliceScanner(tokens)); got != want {
+		t.Errorf("ChannelScanner=%016x, want %016x", got, want)
+	}
+}
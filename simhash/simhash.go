@@ -4,42 +4,268 @@ Package simhash implements the simhash document similarity hashing function.
 http://www.cs.princeton.edu/courses/archive/spr04/cos598B/bib/CharikarEstim.pdf
 http://infolab.stanford.edu/~manku/papers/07www-duplicates.pdf
 http://irl.cse.tamu.edu/people/sadhan/papers/cikm2011.pdf
+
+Hash returns a 64-bit signature.  Hash128 and Hash256 return wider signatures
+as arrays of words, most significant word first.
 */
 package simhash
 
 import (
+	"io"
+
 	"github.com/dchest/siphash"
 	"github.com/dgryski/go-bits"
 )
 
+// Hasher computes 64-bit simhash values using a configurable feature hash.
+// The zero value hashes features with SipHash-2-4 and a zero key, as Hash does.
+type Hasher struct {
+	feature func([]byte) uint64
+	k0, k1  uint64
+}
+
+// NewHasher returns a Hasher which hashes each feature with f, for
+// compatibility with signatures built using FNV, MurmurHash3 or xxHash
+func NewHasher(f func([]byte) uint64) *Hasher {
+	return &Hasher{feature: f}
+}
+
+// NewSipHasher returns a Hasher which hashes each feature with SipHash-2-4
+// keyed with k0 and k1, so that collisions can't be crafted without the key
+func NewSipHasher(k0, k1 uint64) *Hasher {
+	return &Hasher{k0: k0, k1: k1}
+}
+
+func (h *Hasher) hash(b []byte) uint64 {
+	if h.feature != nil {
+		return h.feature(b)
+	}
+	return siphash.Hash(h.k0, h.k1, b)
+}
+
+// Hash returns a simhash value for the document returned by the scanner
+func (h *Hasher) Hash(scanner FeatureScanner) uint64 {
+	var c counter
+
+	for scanner.Scan() {
+		b := scanner.Bytes()
+		c.add(h.hash(b))
+	}
+
+	return c.fold()
+}
+
+var defaultHasher Hasher
+
 // Hash returns a simhash value for the document returned by the scanner
 func Hash(scanner FeatureScanner) uint64 {
-	var signs [64]int64
+	return defaultHasher.Hash(scanner)
+}
+
+// ReaderOptions configure HashReader
+type ReaderOptions struct {
+	// N is the length of the byte n-gram shingles; 0 means 3
+	N int
+
+	// Hasher hashes the shingles; nil means the default, as used by Hash
+	Hasher *Hasher
+}
+
+// readBufferSize is how much HashReader reads at a time
+const readBufferSize = 64 << 10
+
+// HashReader returns a simhash value for the byte n-gram shingles of the
+// document read from r.  It gives the same result as Hash over a bufio.Scanner
+// split with ScanByteNgrams, but slides over a single buffer rather than
+// returning each shingle as a token, and has no limit on the document size.
+func HashReader(r io.Reader, opts *ReaderOptions) (uint64, error) {
+	n := 3
+	h := &defaultHasher
+	if opts != nil {
+		if opts.N > 0 {
+			n = opts.N
+		}
+		if opts.Hasher != nil {
+			h = opts.Hasher
+		}
+	}
+
+	var c counter
+
+	buf := make([]byte, n-1+readBufferSize)
+
+	// the first n-1 bytes of buf are carried over from the previous read
+	var carry int
+	for {
+		m, err := io.ReadFull(r, buf[carry:])
+		end := carry + m
+
+		for i := 0; i+n <= end; i++ {
+			c.add(h.hash(buf[i : i+n]))
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		carry = copy(buf, buf[end-(n-1):end])
+	}
+
+	return c.fold(), nil
+}
+
+// Hash128 returns a 128-bit simhash value for the document returned by the scanner
+func Hash128(scanner FeatureScanner) [2]uint64 {
+	var c [2]counter
+
+	for scanner.Scan() {
+		b := scanner.Bytes()
+		h0, h1 := siphash.Hash128(0, 0, b)
+		c[0].add(h0)
+		c[1].add(h1)
+	}
+
+	return [2]uint64{c[0].fold(), c[1].fold()}
+}
+
+// Hash256 returns a 256-bit simhash value for the document returned by the scanner
+func Hash256(scanner FeatureScanner) [4]uint64 {
+	var c [4]counter
+
+	for scanner.Scan() {
+		b := scanner.Bytes()
+		h0, h1 := siphash.Hash128(0, 0, b)
+		h2, h3 := siphash.Hash128(0, 1, b)
+		c[0].add(h0)
+		c[1].add(h1)
+		c[2].add(h2)
+		c[3].add(h3)
+	}
+
+	return [4]uint64{c[0].fold(), c[1].fold(), c[2].fold(), c[3].fold()}
+}
+
+// HashWeighted returns a simhash value for the weighted features returned by
+// the scanner.  Each feature adds its weight to the bits set in its hash and
+// subtracts it from the others.  With all weights 1 it is the same as Hash.
+func (h *Hasher) HashWeighted(scanner WeightedFeatureScanner) uint64 {
+	var signs [64]float64
 
 	for scanner.Scan() {
 		b := scanner.Bytes()
-		h := siphash.Hash(0, 0, b)
+		f := h.hash(b)
+		w := scanner.Weight()
 
 		for i := 0; i < 64; i++ {
-			negate := int(h) & 1
-			// if negate is 1, we will negate '-1', below
-			r := (-1 ^ -negate) + negate
-			signs[i] += int64(r)
-			h >>= 1
+			if f&1 == 1 {
+				signs[i] += w
+			} else {
+				signs[i] -= w
+			}
+			f >>= 1
 		}
 	}
 
 	var shash uint64
 
-	// TODO: can probably be done with SSE?
 	for i := 63; i >= 0; i-- {
 		shash <<= 1
-		shash |= uint64(signs[i]>>63) & 1
+		if signs[i] < 0 {
+			shash |= 1
+		}
 	}
 
 	return shash
 }
 
+// HashWeighted returns a simhash value for the weighted features returned by
+// the scanner, as Hasher.HashWeighted does for the default Hasher
+func HashWeighted(scanner WeightedFeatureScanner) uint64 {
+	return defaultHasher.HashWeighted(scanner)
+}
+
+// counter accumulates the feature hashes of a simhash.  Rather than adding
+// +1 or -1 to 64 sums for each feature, it counts the set bits at each
+// position with bit-sliced counters: planes[j] holds bit j of the count for
+// all 64 positions, so adding a hash is a ripple-carry add which usually stops
+// after a plane or two.  The planes are flushed into ones before they can
+// overflow.
+type counter struct {
+	planes [8]uint64
+	n      int // hashes in the planes
+	total  int64
+	ones   [64]int64
+}
+
+func (c *counter) add(h uint64) {
+	carry := h
+	for j := 0; carry != 0; j++ {
+		c.planes[j], carry = c.planes[j]^carry, c.planes[j]&carry
+	}
+
+	c.n++
+	if c.n == 1<<uint(len(c.planes))-1 {
+		c.flush()
+	}
+}
+
+func (c *counter) flush() {
+	for j, p := range c.planes {
+		for i := 0; p != 0; i++ {
+			c.ones[i] += int64(p&1) << uint(j)
+			p >>= 1
+		}
+		c.planes[j] = 0
+	}
+
+	c.total += int64(c.n)
+	c.n = 0
+}
+
+// fold returns the simhash: bit i is set if fewer than half the hashes had
+// bit i set, as the sign bits of the sums of +1 and -1 per bit
+func (c *counter) fold() uint64 {
+	c.flush()
+
+	var shash uint64
+
+	for i := 63; i >= 0; i-- {
+		shash <<= 1
+		if 2*c.ones[i] < c.total {
+			shash |= 1
+		}
+	}
+
+	return shash
+}
+
+// FNV1a is the 64-bit FNV-1a hash, for use with NewHasher
+func FNV1a(b []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
 func Distance(v1 uint64, v2 uint64) int {
 	return int(bits.Popcnt(v1 ^ v2))
 }
+
+// Distance128 returns the hamming distance between two 128-bit signatures
+func Distance128(v1, v2 [2]uint64) int {
+	return Distance(v1[0], v2[0]) + Distance(v1[1], v2[1])
+}
+
+// Distance256 returns the hamming distance between two 256-bit signatures
+func Distance256(v1, v2 [4]uint64) int {
+	var d int
+	for i := range v1 {
+		d += Distance(v1[i], v2[i])
+	}
+	return d
+}
@@ -2,9 +2,14 @@ package simhash
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func simhashString(s string) uint64 {
@@ -32,3 +37,237 @@ func TestSimHash(t *testing.T) {
 	h4 := simhashString(strings.Repeat("Now is the winter", 241)) // length = 4097
 	fmt.Printf("h=%016x\n", h4)
 }
+
+func TestSimHashWide(t *testing.T) {
+
+	docs := []string{
+		"Now is the winter of our discontent and also the time for all good people to come to the aid of the party",
+		"Now is the winter of our discontent and also the time for all good people to come to the party",
+		"The more we get together together together the more we get together the happier we'll be",
+	}
+
+	var h128 [][2]uint64
+	var h256 [][4]uint64
+	for _, d := range docs {
+		scanner := bufio.NewScanner(strings.NewReader(d))
+		scanner.Split(ScanByteTrigrams)
+		h128 = append(h128, Hash128(scanner))
+
+		scanner = bufio.NewScanner(strings.NewReader(d))
+		scanner.Split(ScanByteTrigrams)
+		h256 = append(h256, Hash256(scanner))
+	}
+
+	if near, far := Distance128(h128[0], h128[1]), Distance128(h128[0], h128[2]); near >= far {
+		t.Errorf("Distance128: near-duplicates at %d, unrelated at %d", near, far)
+	}
+
+	if near, far := Distance256(h256[0], h256[1]), Distance256(h256[0], h256[2]); near >= far {
+		t.Errorf("Distance256: near-duplicates at %d, unrelated at %d", near, far)
+	}
+
+	// the first half of a 256-bit signature is the 128-bit signature
+	for i := range docs {
+		if h256[i][0] != h128[i][0] || h256[i][1] != h128[i][1] {
+			t.Errorf("Hash256(%d)=%016x, want prefix %016x", i, h256[i], h128[i])
+		}
+	}
+}
+
+func TestHashWeighted(t *testing.T) {
+
+	var tokens [][]byte
+	var ones []float64
+	for _, w := range strings.Fields("now is the winter of our discontent made glorious summer by this sun of york") {
+		tokens = append(tokens, []byte(w))
+		ones = append(ones, 1)
+	}
+
+	// unit weights are the same as the unweighted hash
+	if got, want := HashWeighted(NewWeightedSliceScanner(tokens, ones)), Hash(NewSliceScanner(tokens)); got != want {
+		t.Errorf("HashWeighted(unit weights)=%016x, want %016x", got, want)
+	}
+
+	// boosting a feature pulls the hash towards the feature's own hash
+	boosted := []byte("winter")
+	target := HashWeighted(NewWeightedSliceScanner([][]byte{boosted}, []float64{1}))
+
+	prev := 65
+	for _, w := range []float64{0.5, 1, 2, 4, 8, 16, 32} {
+		weights := make([]float64, len(tokens))
+		for i, tok := range tokens {
+			weights[i] = 1
+			if string(tok) == string(boosted) {
+				weights[i] = w
+			}
+		}
+
+		d := Distance(HashWeighted(NewWeightedSliceScanner(tokens, weights)), target)
+		if d > prev {
+			t.Errorf("weight %v: distance to boosted feature %d, was %d", w, d, prev)
+		}
+		prev = d
+	}
+
+	if prev != 0 {
+		t.Errorf("dominant feature: distance %d, want 0", prev)
+	}
+}
+
+func TestHasher(t *testing.T) {
+
+	var tokens [][]byte
+	for _, w := range strings.Fields("now is the winter of our discontent made glorious summer by this sun of york") {
+		tokens = append(tokens, []byte(w))
+	}
+
+	def := Hash(NewSliceScanner(tokens))
+
+	if got := new(Hasher).Hash(NewSliceScanner(tokens)); got != def {
+		t.Errorf("zero Hasher=%016x, want %016x", got, def)
+	}
+
+	if got := NewSipHasher(0, 0).Hash(NewSliceScanner(tokens)); got != def {
+		t.Errorf("NewSipHasher(0, 0)=%016x, want %016x", got, def)
+	}
+
+	if got := NewSipHasher(1, 2).Hash(NewSliceScanner(tokens)); got == def {
+		t.Errorf("NewSipHasher(1, 2)=%016x, same as the zero key", got)
+	}
+
+	// a feature hash returning a constant gives its complement
+	const c = 0x0123456789abcdef
+	if got := NewHasher(func([]byte) uint64 { return c }).Hash(NewSliceScanner(tokens)); got != ^uint64(c) {
+		t.Errorf("NewHasher(constant)=%016x, want %016x", got, ^uint64(c))
+	}
+
+	f := fnv.New64a()
+	f.Write([]byte("winter"))
+	if got, want := FNV1a([]byte("winter")), f.Sum64(); got != want {
+		t.Errorf("FNV1a=%016x, want %016x", got, want)
+	}
+}
+
+func TestHashReader(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(0))
+
+	for _, size := range []int{0, 2, 3, 100, readBufferSize - 1, readBufferSize + 1, 3*readBufferSize + 17} {
+		doc := make([]byte, size)
+		for i := range doc {
+			doc[i] = 'a' + byte(rng.Intn(8))
+		}
+
+		for _, n := range []int{1, 3, 5} {
+			scanner := bufio.NewScanner(bytes.NewReader(doc))
+			scanner.Split(ScanByteNgrams(n))
+			want := Hash(scanner)
+
+			got, err := HashReader(iotest.HalfReader(bytes.NewReader(doc)), &ReaderOptions{N: n})
+			if err != nil || got != want {
+				t.Errorf("HashReader(size=%d, n=%d)=%016x (%v), want %016x", size, n, got, err, want)
+			}
+		}
+	}
+
+	h := NewSipHasher(1, 2)
+	text := "Now is the winter of our discontent"
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Split(ScanByteTrigrams)
+	if got, _ := HashReader(strings.NewReader(text), &ReaderOptions{Hasher: h}); got != h.Hash(scanner) {
+		t.Errorf("HashReader with Hasher=%016x, want %016x", got, h.Hash(scanner))
+	}
+
+	if _, err := HashReader(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader(text))), nil); err != iotest.ErrTimeout {
+		t.Errorf("HashReader(failing reader) err=%v, want %v", err, iotest.ErrTimeout)
+	}
+}
+
+var benchDoc = func() []byte {
+	rng := rand.New(rand.NewSource(0))
+	words := strings.Fields("now is the winter of our discontent made glorious summer by this sun of york")
+	var b bytes.Buffer
+	for b.Len() < 1<<20 {
+		b.WriteString(words[rng.Intn(len(words))])
+		b.WriteByte(' ')
+	}
+	return b.Bytes()
+}()
+
+func BenchmarkHashScanner(b *testing.B) {
+	b.SetBytes(int64(len(benchDoc)))
+	for i := 0; i < b.N; i++ {
+		scanner := bufio.NewScanner(bytes.NewReader(benchDoc))
+		scanner.Split(ScanByteTrigrams)
+		Hash(scanner)
+	}
+}
+
+func BenchmarkHashReader(b *testing.B) {
+	b.SetBytes(int64(len(benchDoc)))
+	for i := 0; i < b.N; i++ {
+		HashReader(bytes.NewReader(benchDoc), nil)
+	}
+}
+
+// hashReference is the original accumulation loop, one feature bit at a time
+func hashReference(h *Hasher, scanner FeatureScanner) uint64 {
+	var signs [64]int64
+
+	for scanner.Scan() {
+		f := h.hash(scanner.Bytes())
+
+		for i := 0; i < 64; i++ {
+			negate := int(f) & 1
+			// if negate is 1, we will negate '-1', below
+			r := (-1 ^ -negate) + negate
+			signs[i] += int64(r)
+			f >>= 1
+		}
+	}
+
+	var shash uint64
+
+	for i := 63; i >= 0; i-- {
+		shash <<= 1
+		shash |= uint64(signs[i]>>63) & 1
+	}
+
+	return shash
+}
+
+func FuzzHash(f *testing.F) {
+
+	f.Add([]byte("Now is the winter of our discontent"), uint16(1))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint16(300))
+	f.Add([]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80, 0xff}, uint16(1000))
+	f.Add([]byte{}, uint16(0))
+
+	// features are the 8-byte words of data, repeated to cross the counter flushes
+	identity := NewHasher(func(b []byte) uint64 {
+		var w [8]byte
+		copy(w[:], b)
+		return binary.LittleEndian.Uint64(w[:])
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte, repeat uint16) {
+		var tokens [][]byte
+		for r := 0; r < int(repeat%2048); r++ {
+			for i := 0; i < len(data); i += 8 {
+				end := i + 8
+				if end > len(data) {
+					end = len(data)
+				}
+				tokens = append(tokens, data[i:end])
+			}
+		}
+
+		if got, want := identity.Hash(NewSliceScanner(tokens)), hashReference(identity, NewSliceScanner(tokens)); got != want {
+			t.Errorf("identity features: Hash=%016x, want %016x", got, want)
+		}
+
+		if got, want := Hash(NewSliceScanner(tokens)), hashReference(&defaultHasher, NewSliceScanner(tokens)); got != want {
+			t.Errorf("siphash features: Hash=%016x, want %016x", got, want)
+		}
+	})
+}
@@ -6,7 +6,9 @@ for Web Crawling" by Manku, Jain, and Sarma,
 
     http://www2007.org/papers/paper215.pdf
 
-It is hard-coded for hamming distance 3 or 6.
+New3 and New6 return stores for hamming distance 3 or 6, and NewK for an
+arbitrary distance k; the permuted tables are computed from k at construction
+time.  New128 and New256 do the same for 128-bit and 256-bit signatures.
 */
 package simstore
 
@@ -29,8 +31,6 @@ func (t table) Len() int           { return len(t) }
 func (t table) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
 func (t table) Less(i, j int) bool { return t[i].hash < t[j].hash }
 
-const mask3 = 0xfffffff000000000
-
 func (t table) find(sig uint64) []uint64 {
 
 	i := sort.Search(len(t), func(i int) bool { return t[i].hash >= sig })
@@ -53,7 +53,11 @@ func NewU64Slice(hashes int) u64store {
 type u64store interface {
 	add(hash uint64)
 	find(sig uint64, mask uint64, d int) []uint64
+	findSorted(sigs []uint64, mask uint64, d int, found func(i int, p uint64))
 	finish()
+	merge(d, rm u64slice) u64store
+	iterate() func() (uint64, bool)
+	corrupt() error
 }
 
 // a store for uint64s
@@ -80,6 +84,23 @@ func (u u64slice) find(sig, mask uint64, d int) []uint64 {
 	return ids
 }
 
+// findSorted searches for each of the sorted signatures sigs, calling found
+// with the index of the query for each match.  Since the queries are sorted
+// each search starts where the previous one left off.
+func (u u64slice) findSorted(sigs []uint64, mask uint64, d int, found func(i int, p uint64)) {
+	var lo int
+	for i, sig := range sigs {
+		prefix := sig & mask
+		lo += sort.Search(len(u)-lo, func(j int) bool { return u[lo+j] >= prefix })
+
+		for j := lo; j < len(u) && u[j]&mask == prefix; j++ {
+			if distance(u[j], sig) <= d {
+				found(i, u[j])
+			}
+		}
+	}
+}
+
 func (u *u64slice) add(p uint64) {
 	*u = append(*u, p)
 }
@@ -88,15 +109,32 @@ func (u u64slice) finish() {
 	sort.Sort(u)
 }
 
+func (u u64slice) corrupt() error { return nil }
+
 // Store is a storage engine for 64-bit hashes
 type Store struct {
 	docids  table
 	rhashes []u64store
+	k       int
+	perms   []permutation
+
+	// number of tables to probe concurrently in Find, and the semaphore
+	// shared by all queries that bounds them
+	parallelism int
+	probes      limiter
+
+	// signatures added after Finish()
+	mu       sync.RWMutex
+	finished bool
+	delta    *delta
+	merging  *delta
+	merges   sync.WaitGroup
+	removed  tombstones
 }
 
 // New3 returns a Store for searching hamming distance <= 3
 func New3(hashes int, newStore func(int) u64store) *Store {
-	s := Store{}
+	s := Store{k: 3, perms: permutations(3)}
 	s.rhashes = make([]u64store, 16)
 	if hashes != 0 {
 		s.docids = make(table, 0, hashes)
@@ -107,45 +145,20 @@ func New3(hashes int, newStore func(int) u64store) *Store {
 	return &s
 }
 
-// Add inserts a signature and document id into the store
+// Add inserts a signature and document id into the store.  Signatures added
+// after Finish() are searchable immediately.
 func (s *Store) Add(sig uint64, docid uint64) {
+	defer s.lockAdd()()
 
-	var t int
-
-	s.docids = append(s.docids, entry{hash: sig, docid: docid})
-
-	for i := 0; i < 4; i++ {
-		p := sig
-		s.rhashes[t].add(p)
-		t++
-
-		p = (sig & 0xffff000000ffffff) | (sig & 0x0000fff000000000 >> 12) | (sig & 0x0000000fff000000 << 12)
-		s.rhashes[t].add(p)
-		t++
-
-		p = (sig & 0xffff000fff000fff) | (sig & 0x0000fff000000000 >> 24) | (sig & 0x0000000000fff000 << 24)
-		s.rhashes[t].add(p)
-		t++
-
-		p = (sig & 0xffff000ffffff000) | (sig & 0x0000fff000000000 >> 36) | (sig & 0x0000000000000fff << 36)
-		s.rhashes[t].add(p)
-		t++
+	s.addDoc(sig, docid)
 
-		sig = (sig << 16) | (sig >> (64 - 16))
+	for t, p := range s.perms {
+		s.add(t, p.shuffle(sig))
 	}
 }
 
-func (*Store) unshuffle(sig uint64, t int) uint64 {
-	const m2 = 0x0000fff000000000
-
-	t4 := t % 4
-	shift := 12 * uint64(t4)
-	m3 := uint64(m2 >> shift)
-	m1 := ^uint64(0) &^ (m2 | m3)
-
-	sig = (sig & m1) | (sig & m2 >> shift) | (sig & m3 << shift)
-	sig = (sig >> (16 * (uint64(t) / 4))) | (sig << (64 - (16 * (uint64(t) / 4))))
-	return sig
+func (s *Store) unshuffle(sig uint64, t int) uint64 {
+	return s.perms[t].unshuffle(sig)
 }
 
 func (s *Store) unshuffleList(sigs []uint64, t int) []uint64 {
@@ -161,10 +174,19 @@ type limiter chan struct{}
 func (l limiter) enter() { l <- struct{}{} }
 func (l limiter) leave() { <-l }
 
-// Finish prepares the store for searching.  This must be called once after all
-// the signatures have been added via Add().
+// Finish prepares the store for searching.  This must be called after the
+// initial signatures have been added via Add().  Calling it again merges any
+// signatures added since into the main tables.
 func (s *Store) Finish() {
 
+	if s.finished {
+		s.flush()
+		return
+	}
+
+	s.finished = true
+	s.delta = newDelta(len(s.rhashes))
+
 	// empty store
 	if len(s.docids) == 0 {
 		return
@@ -186,54 +208,173 @@ func (s *Store) Finish() {
 		}(i)
 	}
 	wg.Wait()
+
+	// documents removed before Finish
+	if s.removed.len() > 0 {
+		s.flush()
+	}
 }
 
-// Find searches the store for all hashes hamming distance 3 or less from the
-// query signature.  It returns the associated list of document ids.
+// Find searches the store for all hashes hamming distance k or less from the
+// query signature, where k is the distance the store was built for.  It
+// returns the associated list of document ids.
 func (s *Store) Find(sig uint64) []uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.docidsFor(s.candidates(sig, s.k))
+}
+
+// FindMatches is like Find but returns the signature and distance of each
+// match as well, sorted by distance and then document id.
+func (s *Store) FindMatches(sig uint64) []Match {
+	return s.FindMatchesWithin(sig, s.k)
+}
+
+// FindMatchesWithin is like FindMatches but only returns documents within
+// distance d of the query signature.  A d greater than k is treated as k.
+func (s *Store) FindMatchesWithin(sig uint64, d int) []Match {
+	if d > s.k {
+		d = s.k
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.matchesFor(sig, s.candidates(sig, d))
+}
+
+// FindWithin is like Find but only returns documents within distance d of the
+// query signature.  A d greater than k is treated as k.
+func (s *Store) FindWithin(sig uint64, d int) []uint64 {
+	if d > s.k {
+		d = s.k
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.docidsFor(s.candidates(sig, d))
+}
+
+// candidates returns the distinct stored signatures within distance d of sig
+func (s *Store) candidates(sig uint64, d int) []uint64 {
 
 	// empty store
-	if len(s.docids) == 0 {
+	if s.empty() {
 		return nil
 	}
 
+	if s.parallelism > 1 {
+		return s.probeParallel(sig, d)
+	}
+
 	var ids []uint64
 
-	// TODO(dgryski): search in parallel
-	var t int
-	for i := 0; i < 4; i++ {
-		p := sig
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	for t, p := range s.perms {
+		ids = append(ids, s.unshuffleList(s.findTable(t, p.shuffle(sig), p.mask, d), t)...)
+	}
+
+	return unique(ids)
+}
+
+// SetParallelism sets the number of permuted tables probed concurrently.  The
+// limit is shared by all queries on the store, so concurrent searches together
+// use at most n goroutines.  The default, 1, probes the tables serially in the
+// calling goroutine.
+func (s *Store) SetParallelism(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parallelism = n
+	s.probes = nil
+	if n > 1 {
+		s.probes = make(limiter, n)
+	}
+}
 
-		p = (sig & 0xffff000000ffffff) | (sig & 0x0000fff000000000 >> 12) | (sig & 0x0000000fff000000 << 12)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+// probeParallel searches all the permuted tables, at most s.parallelism at a
+// time across all queries, and returns the distinct signatures within
+// distance d of sig
+func (s *Store) probeParallel(sig uint64, d int) []uint64 {
+	results := make([][]uint64, len(s.perms))
 
-		p = (sig & 0xffff000fff000fff) | (sig & 0x0000fff000000000 >> 24) | (sig & 0x0000000000fff000 << 24)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	l := s.probes
 
-		p = (sig & 0xffff000ffffff000) | (sig & 0x0000fff000000000 >> 36) | (sig & 0x0000000000000fff << 36)
-		ids = append(ids, s.unshuffleList(s.rhashes[t].find(p, mask3, 3), t)...)
-		t++
+	var wg sync.WaitGroup
 
-		sig = (sig << 16) | (sig >> (64 - 16))
+	for t := range s.perms {
+		l.enter()
+		wg.Add(1)
+		go func(t int) {
+			p := s.perms[t]
+			ids := s.findTable(t, p.shuffle(sig), p.mask, d)
+			for i := range ids {
+				ids[i] = p.unshuffle(ids[i])
+			}
+			results[t] = ids
+			l.leave()
+			wg.Done()
+		}(t)
 	}
+	wg.Wait()
 
-	ids = unique(ids)
+	var ids []uint64
+	for _, r := range results {
+		ids = append(ids, r...)
+	}
+
+	return unique(ids)
+}
 
+// Err returns the error for the first corrupt compressed block found while
+// searching, or nil.  The signatures in a corrupt block are missing from
+// search results.  Stores read with ReadStore have had their checksum
+// verified; this is for mapped stores, which are only checked by Verify.
+func (s *Store) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.rhashes {
+		if r == nil {
+			continue
+		}
+		if err := r.corrupt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docidsFor returns the document ids for the signatures sigs
+func (s *Store) docidsFor(sigs []uint64) []uint64 {
 	var docids []uint64
-	for _, v := range ids {
-		docids = append(docids, s.docids.find(v)...)
+	for _, v := range sigs {
+		docids = append(docids, s.findDoc(v)...)
 	}
 
 	return docids
 }
 
+// matchesFor returns the documents for the signatures sigs as matches for the
+// query sig
+func (s *Store) matchesFor(sig uint64, sigs []uint64) []Match {
+	var m []Match
+	for _, v := range sigs {
+		d := distance(v, sig)
+		for _, id := range s.findDoc(v) {
+			m = append(m, Match{DocID: id, Sig: v, Distance: d})
+		}
+	}
+
+	sort.Sort(matches(m))
+	return m
+}
+
 // SmallStore3 is a simstore for distance k=3 with smaller memory requirements
 type SmallStore3 struct {
-	tables [4][1 << 16]table
+	tables  [4][1 << 16]table
+	removed map[uint64]struct{}
 }
 
 func New3Small(hashes int) *SmallStore3 {
@@ -242,6 +383,12 @@ func New3Small(hashes int) *SmallStore3 {
 
 func (s *SmallStore3) Add(sig uint64, docid uint64) {
 
+	// a removed document added again: drop the old copies now, so that
+	// compaction doesn't take the new one with them
+	if _, ok := s.removed[docid]; ok {
+		s.compact()
+	}
+
 	for i := 0; i < 4; i++ {
 		prefix := (sig & 0xffff000000000000) >> (64 - 16)
 		s.tables[i][prefix] = append(s.tables[i][prefix], entry{hash: sig, docid: docid})
@@ -250,6 +397,16 @@ func (s *SmallStore3) Add(sig uint64, docid uint64) {
 }
 
 func (s *SmallStore3) Find(sig uint64) []uint64 {
+	return s.FindWithin(sig, 3)
+}
+
+// FindWithin is like Find but only returns documents within distance d of the
+// query signature.  A d greater than 3 is treated as 3.
+func (s *SmallStore3) FindWithin(sig uint64, d int) []uint64 {
+	if d > 3 {
+		d = 3
+	}
+
 	var ids []uint64
 	for i := 0; i < 4; i++ {
 		prefix := (sig & 0xffff000000000000) >> (64 - 16)
@@ -257,7 +414,10 @@ func (s *SmallStore3) Find(sig uint64) []uint64 {
 		t := s.tables[i][prefix]
 
 		for i := range t {
-			if distance(t[i].hash, sig) <= 3 {
+			if _, ok := s.removed[t[i].docid]; ok {
+				continue
+			}
+			if distance(t[i].hash, sig) <= d {
 				ids = append(ids, t[i].docid)
 			}
 		}
@@ -266,7 +426,45 @@ func (s *SmallStore3) Find(sig uint64) []uint64 {
 	return unique(ids)
 }
 
+// FindMatches is like Find but returns the signature and distance of each
+// match as well, sorted by distance and then document id.
+func (s *SmallStore3) FindMatches(sig uint64) []Match {
+	return s.FindMatchesWithin(sig, 3)
+}
+
+// FindMatchesWithin is like FindMatches but only returns documents within
+// distance d of the query signature.  A d greater than 3 is treated as 3.
+func (s *SmallStore3) FindMatchesWithin(sig uint64, d int) []Match {
+	seen := make(map[entry]struct{})
+	var m []Match
+	for i := 0; i < 4; i++ {
+		prefix := (sig & 0xffff000000000000) >> (64 - 16)
+
+		t := s.tables[i][prefix]
+
+		for j := range t {
+			if _, ok := s.removed[t[j].docid]; ok {
+				continue
+			}
+			if dist := distance(t[j].hash, sig); dist <= d && dist <= 3 {
+				// undo the rotation to recover the stored signature
+				h := (t[j].hash >> (16 * uint(i))) | (t[j].hash << (64 - 16*uint(i)))
+				e := entry{hash: h, docid: t[j].docid}
+				if _, ok := seen[e]; !ok {
+					seen[e] = struct{}{}
+					m = append(m, Match{DocID: e.docid, Sig: h, Distance: dist})
+				}
+			}
+		}
+		sig = (sig << 16) | (sig >> (64 - 16))
+	}
+
+	sort.Sort(matches(m))
+	return m
+}
+
 func (s *SmallStore3) Finish() {
+	s.compact()
 	for i := range s.tables {
 		for p := range s.tables[i] {
 			sort.Sort(s.tables[i][p])
@@ -274,6 +472,28 @@ func (s *SmallStore3) Finish() {
 	}
 }
 
+// Match is a document found by FindMatches
+type Match struct {
+	DocID    uint64
+	Sig      uint64
+	Distance int
+}
+
+// matches sorts by distance and then document id
+type matches []Match
+
+func (m matches) Len() int      { return len(m) }
+func (m matches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m matches) Less(i, j int) bool {
+	if m[i].Distance != m[j].Distance {
+		return m[i].Distance < m[j].Distance
+	}
+	if m[i].DocID != m[j].DocID {
+		return m[i].DocID < m[j].DocID
+	}
+	return m[i].Sig < m[j].Sig
+}
+
 func unique(ids []uint64) []uint64 {
 	// dedup ids
 	uniq := make(map[uint64]struct{})
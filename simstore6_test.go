@@ -2,6 +2,7 @@ package simstore
 
 import (
 	"math/rand"
+	"sort"
 	"testing"
 )
 
@@ -78,3 +79,129 @@ func testAdd(t *testing.T, s Storage, size, queries, d int) {
 		t.Logf("fails = %f", 100*float64(fails)/float64(queries))
 	}
 }
+
+// testStore is a store under test and the distance it searches
+type testStore struct {
+	name string
+	s    Storage
+	d    int
+}
+
+// newTestStores returns an empty store of each kind, sized for n signatures
+func newTestStores(n int) []testStore {
+	return []testStore{
+		{"store3", New3(n, NewU64Slice), 3},
+		{"store3z", New3(n, NewZStore), 3},
+		{"small3", New3Small(n), 3},
+		{"store6", New6(n, NewU64Slice), 6},
+		{"store6z", New6(n, NewZStore), 6},
+		{"storeK", NewK(4, n, NewU64Slice), 4},
+		{"storeKz", NewK(2, n, NewZStore), 2},
+	}
+}
+
+// fillStores adds the same n random signatures to each store as documents 0
+// to n-1 and finishes it.  It returns the signatures, and the random source
+// for choosing queries.
+func fillStores(tb testing.TB, stores []testStore, n int) ([]uint64, *rand.Rand) {
+	tb.Helper()
+	var sigs []uint64
+	var rng *rand.Rand
+	for _, ts := range stores {
+		rng = rand.New(rand.NewSource(0))
+		sigs = fillStore(tb, ts.s, n, rng)
+		ts.s.Finish()
+	}
+	return sigs, rng
+}
+
+// fillStore adds n random signatures to s as documents 0 to n-1 and returns
+// them
+func fillStore(tb testing.TB, s interface{ Add(sig, docid uint64) }, n int, rng *rand.Rand) []uint64 {
+	tb.Helper()
+	sigs := make([]uint64, n)
+	for i := range sigs {
+		sigs[i] = uint64(rng.Int63())
+		s.Add(sigs[i], uint64(i))
+	}
+	return sigs
+}
+
+// query returns one of sigs with up to d random bits flipped
+func query(rng *rand.Rand, sigs []uint64, d int) uint64 {
+	q := sigs[rng.Intn(len(sigs))]
+	for i := rng.Intn(d + 1); i > 0; i-- {
+		q ^= 1 << uint(rng.Intn(64))
+	}
+	return q
+}
+
+// within returns the documents of sigs within distance d of q, as found by
+// FindMatchesWithin
+func within(sigs []uint64, q uint64, d int) []Match {
+	var m []Match
+	for i, sig := range sigs {
+		if dist := distance(sig, q); dist <= d {
+			m = append(m, Match{DocID: uint64(i), Sig: sig, Distance: dist})
+		}
+	}
+	sort.Sort(matches(m))
+	return m
+}
+
+func docIDs(m []Match) []uint64 {
+	var ids []uint64
+	for _, v := range m {
+		ids = append(ids, v.DocID)
+	}
+	return sortedIDs(ids)
+}
+
+func contains(ids []uint64, id uint64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+type parallelStorage interface {
+	Storage
+	SetParallelism(n int)
+}
+
+func benchmarkFind(b *testing.B, s parallelStorage, parallelism int) {
+	const signatures = 100000
+
+	sigs := fillStore(b, s, signatures, rand.New(rand.NewSource(0)))
+	s.Finish()
+	s.SetParallelism(parallelism)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.Find(sigs[i%signatures])
+	}
+}
+
+func BenchmarkFind6(b *testing.B)          { benchmarkFind(b, New6(100000, NewU64Slice), 1) }
+func BenchmarkFind6Parallel(b *testing.B)  { benchmarkFind(b, New6(100000, NewU64Slice), 8) }
+func BenchmarkFind6Z(b *testing.B)         { benchmarkFind(b, New6(100000, NewZStore), 1) }
+func BenchmarkFind6ZParallel(b *testing.B) { benchmarkFind(b, New6(100000, NewZStore), 8) }
+
+func BenchmarkFind6ZBatch(b *testing.B) {
+	const signatures = 100000
+
+	s := New6(signatures, NewZStore)
+	sigs := fillStore(b, s, signatures, rand.New(rand.NewSource(0)))
+	s.Finish()
+
+	b.ResetTimer()
+
+	// compare ns/op with 1000 * BenchmarkFind6Z
+	for i := 0; i < b.N; i++ {
+		j := (i * 1000) % signatures
+		s.FindBatch(sigs[j : j+1000])
+	}
+}
@@ -1,6 +1,13 @@
 package simstore
 
 import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
 )
@@ -40,3 +47,639 @@ func TestUnshuffle6(t *testing.T) {
 
 	quick.Check(f, nil)
 }
+
+func TestFindMatches(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	// a document sharing a signature, merged into the main tables
+	for _, ts := range stores {
+		ts.s.Add(sigs[0], uint64(len(sigs)))
+		ts.s.Finish()
+	}
+	sigs = append(sigs, sigs[0])
+
+	for j := 0; j < queries/10000; j++ {
+		q := query(rng, sigs, 6)
+		if j == 0 {
+			q = sigs[0]
+		}
+
+		for _, ts := range stores {
+			if got, want := ts.s.FindMatches(q), within(sigs, q, ts.d); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: FindMatches(%016x)=%v, want %v", ts.name, q, got, want)
+			}
+		}
+	}
+}
+
+func TestFindWithin(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	for j := 0; j < queries/10000; j++ {
+		q := query(rng, sigs, 6)
+
+		for _, ts := range stores {
+			for d := 0; d <= ts.d+1; d++ {
+				want := within(sigs, q, ts.d)
+				if d < ts.d {
+					want = within(sigs, q, d)
+				}
+
+				if got := sortedIDs(ts.s.FindWithin(q, d)); !equalIDs(got, docIDs(want)) {
+					t.Errorf("%s: FindWithin(%016x, %d)=%v, want %v", ts.name, q, d, got, docIDs(want))
+				}
+
+				if got := ts.s.FindMatchesWithin(q, d); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: FindMatchesWithin(%016x, %d)=%v, want %v", ts.name, q, d, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFindBatch(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	// some signatures added after Finish are in the delta
+	for i := 0; i < 100; i++ {
+		sig := uint64(rng.Int63())
+		for _, ts := range stores {
+			ts.s.Add(sig, uint64(len(sigs)))
+		}
+		sigs = append(sigs, sig)
+	}
+
+	var qs []uint64
+	for j := 0; j < 500; j++ {
+		qs = append(qs, query(rng, sigs, 7))
+	}
+	// duplicate queries
+	qs = append(qs, qs[:10]...)
+
+	for _, ts := range stores {
+		got := ts.s.FindBatch(qs)
+		if len(got) != len(qs) {
+			t.Fatalf("%s: len(FindBatch)=%d, want %d", ts.name, len(got), len(qs))
+		}
+
+		for i, q := range qs {
+			if g, want := sortedIDs(got[i]), sortedIDs(ts.s.Find(q)); !equalIDs(g, want) {
+				t.Errorf("%s: FindBatch()[%d]=%v, want Find(%016x)=%v", ts.name, i, g, q, want)
+			}
+		}
+	}
+}
+
+func TestFindParallel(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	for j := 0; j < queries/10000; j++ {
+		q := query(rng, sigs, 6)
+
+		for _, ts := range stores {
+			s, ok := ts.s.(parallelStorage)
+			if !ok {
+				continue
+			}
+
+			s.SetParallelism(1)
+			want := s.FindMatches(q)
+			s.SetParallelism(4)
+			got := s.FindMatches(q)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: parallel FindMatches(%016x)=%v, want %v", ts.name, q, got, want)
+			}
+		}
+	}
+}
+
+// Concurrent queries share the store's probe limit, and it may be changed
+// while they run
+func TestFindParallelConcurrent(t *testing.T) {
+
+	s := New6(size/50, NewU64Slice)
+	sigs := fillStore(t, s, size/50, rand.New(rand.NewSource(0)))
+	s.Finish()
+	s.SetParallelism(2)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				i := g*50 + j
+				if !contains(s.Find(sigs[i]), uint64(i)) {
+					t.Errorf("Find(sigs[%d]) did not find document %d", i, i)
+				}
+			}
+		}(g)
+	}
+
+	for n := 1; n <= 4; n++ {
+		s.SetParallelism(n)
+	}
+	wg.Wait()
+
+	if got := cap(s.probes); got != 4 {
+		t.Errorf("cap(probes)=%d, want 4", got)
+	}
+}
+
+func TestAddAfterFinish(t *testing.T) {
+
+	const inserts = size / 500
+
+	stores := newTestStores(size / 50)
+	_, rng := fillStores(t, stores, size/50)
+
+	var sigs []uint64
+	for i := 0; i < inserts; i++ {
+		sig := uint64(rng.Int63())
+		sigs = append(sigs, sig)
+		docid := uint64(size/50 + i)
+
+		for _, ts := range stores {
+			ts.s.Add(sig, docid)
+
+			// searchable immediately, whether in the delta, being merged, or merged
+			q := sig
+			for j := 0; j < ts.d; j++ {
+				q ^= 1 << uint(rng.Intn(64))
+			}
+			if !contains(ts.s.Find(q), docid) {
+				t.Fatalf("%s: Find(%016x) missing docid %d", ts.name, q, docid)
+			}
+		}
+	}
+
+	for _, ts := range stores {
+		p, ok := ts.s.(interface{ pending() int })
+		if ok && p.pending() == 0 {
+			t.Errorf("%s: no pending inserts before Finish", ts.name)
+		}
+
+		ts.s.Finish()
+
+		if ok && p.pending() != 0 {
+			t.Errorf("%s: %d pending inserts after Finish", ts.name, p.pending())
+		}
+
+		for i, sig := range sigs {
+			if !contains(ts.s.Find(sig), uint64(size/50+i)) {
+				t.Errorf("%s: after merge Find(%016x) missing docid %d", ts.name, sig, size/50+i)
+			}
+		}
+	}
+}
+
+func TestAddAfterFinishConcurrent(t *testing.T) {
+
+	s := New3(1000, NewU64Slice)
+
+	rng := rand.New(rand.NewSource(0))
+	fillStore(t, s, 1000, rng)
+	s.Finish()
+
+	sigs := make([]uint64, 3000)
+	for i := range sigs {
+		sigs[i] = uint64(rng.Int63())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		for i, sig := range sigs {
+			s.Add(sig, uint64(1000+i))
+		}
+		wg.Done()
+	}()
+	go func() {
+		for _, sig := range sigs {
+			s.Find(sig)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != errPending {
+		t.Errorf("WriteTo with pending inserts: err=%v, want %v", err, errPending)
+	}
+
+	s.Finish()
+
+	for i, sig := range sigs {
+		if !contains(s.Find(sig), uint64(1000+i)) {
+			t.Errorf("Find(%016x) missing docid %d", sig, 1000+i)
+		}
+	}
+
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo: %v", err)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	for _, ts := range stores {
+		var buf bytes.Buffer
+		n, err := ts.s.(io.WriterTo).WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("%s: WriteTo: %v", ts.name, err)
+		}
+		if n != int64(buf.Len()) {
+			t.Errorf("%s: WriteTo=%d, wrote %d bytes", ts.name, n, buf.Len())
+		}
+
+		s, err := ReadStore(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: ReadStore: %v", ts.name, err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[rng.Intn(len(sigs))] ^ 1<<uint(rng.Intn(64))
+			if got, want := sortedIDs(s.Find(q)), sortedIDs(ts.s.Find(q)); !equalIDs(got, want) || len(got) == 0 {
+				t.Errorf("%s: Find(%016x)=%v, want %v", ts.name, q, got, want)
+			}
+		}
+
+		// finishing a loaded store is harmless
+		s.Finish()
+
+		b := buf.Bytes()
+		b[len(b)/2] ^= 0x01
+		if _, err := ReadStore(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: ReadStore succeeded on corrupted data", ts.name)
+		}
+
+		if _, err := ReadStore(bytes.NewReader(b[:len(b)-8])); err == nil {
+			t.Errorf("%s: ReadStore succeeded on truncated data", ts.name)
+		}
+	}
+}
+
+func TestWriteBeforeFinish(t *testing.T) {
+
+	for _, ts := range newTestStores(10) {
+		// SmallStore3 needs no Finish before writing
+		if _, ok := ts.s.(*SmallStore3); ok {
+			continue
+		}
+
+		ts.s.Add(1, 2)
+		ts.s.Add(0xffff, 3)
+
+		var buf bytes.Buffer
+		if _, err := ts.s.(io.WriterTo).WriteTo(&buf); err != errNotFinished {
+			t.Errorf("%s: WriteTo before Finish: err=%v, want %v", ts.name, err, errNotFinished)
+		}
+
+		ts.s.Finish()
+		buf.Reset()
+		if _, err := ts.s.(io.WriterTo).WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo after Finish: %v", ts.name, err)
+		}
+
+		s, err := ReadStore(&buf)
+		if err != nil {
+			t.Fatalf("%s: ReadStore: %v", ts.name, err)
+		}
+		if got := s.Find(0x1); !equalIDs(got, []uint64{2}) {
+			t.Errorf("%s: Find(0x1)=%v, want [2]", ts.name, got)
+		}
+	}
+}
+
+func TestReadStoreErrors(t *testing.T) {
+
+	var buf bytes.Buffer
+	s := New3(1, NewU64Slice)
+	s.Add(1, 1)
+	s.Finish()
+	s.WriteTo(&buf)
+
+	b := append([]byte(nil), buf.Bytes()...)
+	b[0] = 'x'
+	if _, err := ReadStore(bytes.NewReader(b)); err != ErrInvalidFormat {
+		t.Errorf("bad magic: err=%v, want %v", err, ErrInvalidFormat)
+	}
+
+	b = append([]byte(nil), buf.Bytes()...)
+	b[len(fileMagic)] = fileVersion + 1
+	if _, err := ReadStore(bytes.NewReader(b)); err != ErrUnsupportedVersion {
+		t.Errorf("bad version: err=%v, want %v", err, ErrUnsupportedVersion)
+	}
+
+	b = append([]byte(nil), buf.Bytes()...)
+	b[len(b)-1] ^= 0xff
+	if _, err := ReadStore(bytes.NewReader(b)); err != ErrChecksum {
+		t.Errorf("bad checksum: err=%v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestOpenMapped(t *testing.T) {
+
+	stores := newTestStores(size / 50)
+	sigs, rng := fillStores(t, stores, size/50)
+
+	dir := t.TempDir()
+
+	for _, ts := range stores {
+		path := filepath.Join(dir, ts.name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.s.(io.WriterTo).WriteTo(f); err != nil {
+			t.Fatalf("%s: WriteTo: %v", ts.name, err)
+		}
+		f.Close()
+
+		m, err := OpenMapped(path)
+		if err != nil {
+			t.Fatalf("%s: OpenMapped: %v", ts.name, err)
+		}
+
+		m.Finish()
+
+		for i := 0; i < 1000; i++ {
+			q := sigs[rng.Intn(len(sigs))] ^ 1<<uint(rng.Intn(64))
+			if got, want := sortedIDs(m.Find(q)), sortedIDs(ts.s.Find(q)); !equalIDs(got, want) || len(got) == 0 {
+				t.Errorf("%s: Find(%016x)=%v, want %v", ts.name, q, got, want)
+			}
+		}
+
+		if err := m.Close(); err != nil {
+			t.Errorf("%s: Close: %v", ts.name, err)
+		}
+	}
+}
+
+func TestOpenMappedErrors(t *testing.T) {
+
+	dir := t.TempDir()
+
+	s := New3(1, NewU64Slice)
+	s.Add(1, 1)
+	s.Finish()
+
+	path := filepath.Join(dir, "store")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WriteTo(f)
+	f.Close()
+
+	if err := os.Truncate(path, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMapped(path); err != ErrInvalidFormat {
+		t.Errorf("truncated file: err=%v, want %v", err, ErrInvalidFormat)
+	}
+
+	if _, err := OpenMapped(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("missing file: expected error")
+	}
+}
+
+func TestOpenMappedCorrupt(t *testing.T) {
+
+	dir := t.TempDir()
+
+	s := New3(size/50, NewZStore)
+	fillStore(t, s, size/50, rand.New(rand.NewSource(0)))
+	s.Finish()
+
+	// the first table's blocks no longer cover its index
+	z := s.rhashes[0].(*zstore)
+	b := z.b
+	z.b = b[:len(b)-2*blockSize]
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	z.b = b
+
+	path := filepath.Join(dir, "short")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMapped(path); err != ErrInvalidFormat {
+		t.Errorf("short zstore table: OpenMapped err=%v, want %v", err, ErrInvalidFormat)
+	}
+
+	if _, err := ReadStore(bytes.NewReader(buf.Bytes())); err != ErrInvalidFormat {
+		t.Errorf("short zstore table: ReadStore err=%v, want %v", err, ErrInvalidFormat)
+	}
+
+	buf.Reset()
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a flipped bit in the first document's signature is structurally valid
+	data := buf.Bytes()
+	data[len(fileMagic)+16+8] ^= 1
+
+	path = filepath.Join(dir, "flipped")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("flipped bit: OpenMapped: %v", err)
+	}
+	if err := m.Verify(); err != ErrChecksum {
+		t.Errorf("flipped bit: Verify err=%v, want %v", err, ErrChecksum)
+	}
+	m.Close()
+
+	data[len(fileMagic)+16+8] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped: %v", err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	m.Close()
+}
+
+type removeStorage interface {
+	Storage
+	Remove(sig, docid uint64)
+	RemoveDocID(docid uint64)
+}
+
+func TestRemove(t *testing.T) {
+
+	const signatures = size / 500
+
+	for _, tt := range newTestStores(signatures) {
+		rs := tt.s.(removeStorage)
+		sigs := fillStore(t, tt.s, signatures, rand.New(rand.NewSource(0)))
+
+		// a second document sharing a signature must survive its removal
+		tt.s.Add(sigs[0], signatures)
+
+		// removed before Finish
+		rs.RemoveDocID(1)
+
+		tt.s.Finish()
+
+		removed := map[uint64]bool{0: true, 1: true}
+		rs.Remove(sigs[0], 0)
+		for i := 2; i < signatures; i += 3 {
+			if i%2 == 0 {
+				rs.Remove(sigs[i], uint64(i))
+			} else {
+				rs.RemoveDocID(uint64(i))
+			}
+			removed[uint64(i)] = true
+		}
+
+		check := func(when string) {
+			for i, sig := range sigs {
+				found := contains(tt.s.Find(sig^1), uint64(i))
+				if found == removed[uint64(i)] {
+					t.Fatalf("%s %s: Find(sigs[%d]) found=%v, want %v", tt.name, when, i, found, !found)
+				}
+			}
+			if !contains(tt.s.Find(sigs[0]), signatures) {
+				t.Fatalf("%s %s: Find(sigs[0]) lost the second document", tt.name, when)
+			}
+		}
+
+		check("before compaction")
+		tt.s.Finish()
+		check("after compaction")
+
+		switch s := tt.s.(type) {
+		case *Store:
+			checkCompacted(t, tt.name, s, signatures+1-len(removed))
+		case *Store6:
+			checkCompacted(t, tt.name, &s.Store, signatures+1-len(removed))
+		}
+	}
+}
+
+func checkCompacted(t *testing.T, name string, s *Store, want int) {
+	if n := s.pending(); n != 0 {
+		t.Errorf("%s: %d pending after Finish", name, n)
+	}
+	if len(s.docids) != want {
+		t.Errorf("%s: len(docids)=%d, want %d", name, len(s.docids), want)
+	}
+	// the surviving document sharing sigs[0] keeps a second copy in the tables
+	if u, ok := s.rhashes[0].(*u64slice); ok && len(*u) != want+1 {
+		t.Errorf("%s: len(rhashes[0])=%d, want %d", name, len(*u), want+1)
+	}
+}
+
+func TestRemoveBackground(t *testing.T) {
+
+	s := New3(10000, NewU64Slice)
+
+	sigs := fillStore(t, s, 10000, rand.New(rand.NewSource(0)))
+	s.Finish()
+
+	for i := 0; i < 5000; i++ {
+		s.RemoveDocID(uint64(i))
+	}
+
+	// enough removals to have triggered a background compaction
+	s.merges.Wait()
+	if s.removed.len() >= 5000 {
+		t.Errorf("no background compaction: %d tombstones", s.removed.len())
+	}
+
+	for i, sig := range sigs {
+		if found := contains(s.Find(sig), uint64(i)); found != (i >= 5000) {
+			t.Errorf("Find(sigs[%d]) found=%v", i, found)
+		}
+	}
+}
+
+// Re-crawled documents are removed and added again, possibly with a new
+// signature.  Only the new copies may be found, before and after compaction.
+func TestRemoveAddAgain(t *testing.T) {
+
+	stores := newTestStores(size / 500)
+	sigs, _ := fillStores(t, stores, size/500)
+
+	for _, tt := range stores {
+		rs := tt.s.(removeStorage)
+
+		// document 1 keeps its signature, document 2 gets a new one
+		newSig := sigs[2] ^ 0xff00ff00ff
+		rs.Remove(sigs[1], 1)
+		tt.s.Add(sigs[1], 1)
+		rs.RemoveDocID(2)
+		tt.s.Add(newSig, 2)
+
+		check := func(when string) {
+			if got := tt.s.Find(sigs[1]); !equalIDs(got, []uint64{1}) {
+				t.Errorf("%s %s: Find(sigs[1])=%v, want [1]", tt.name, when, got)
+			}
+			if got := tt.s.Find(sigs[2]); len(got) != 0 {
+				t.Errorf("%s %s: Find(old sigs[2])=%v, want []", tt.name, when, got)
+			}
+			if got := tt.s.Find(newSig); !equalIDs(got, []uint64{2}) {
+				t.Errorf("%s %s: Find(new sigs[2])=%v, want [2]", tt.name, when, got)
+			}
+		}
+
+		check("before compaction")
+		tt.s.Finish()
+		check("after compaction")
+
+		// removing it again removes the new copy as well
+		rs.RemoveDocID(2)
+		tt.s.Finish()
+		if got := tt.s.Find(newSig); len(got) != 0 {
+			t.Errorf("%s: Find(new sigs[2]) after second removal=%v, want []", tt.name, got)
+		}
+	}
+}
+
+// A merge forgets only the tombstones it compacted, not ones renewed since
+func TestTombstonesForget(t *testing.T) {
+	var ts tombstones
+
+	e := entry{hash: 1, docid: 2}
+	ts.removeEntry(e)
+	ts.removeDocID(3)
+
+	c := ts.clone()
+	ts.removeEntry(e)
+	ts.forget(c)
+
+	if !ts.dead(e) {
+		t.Errorf("renewed tombstone was forgotten")
+	}
+	if ts.dead(entry{hash: 5, docid: 3}) {
+		t.Errorf("compacted tombstone was not forgotten")
+	}
+}
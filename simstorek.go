@@ -0,0 +1,110 @@
+package simstore
+
+import "fmt"
+
+// permutation describes one of the permuted tables of a Store.  A signature
+// is rotated left so that a top-level block is at the front, and then one of
+// the sub-blocks of the remaining bits is swapped up to sit directly behind
+// it.  The first mask bits of the result must match exactly for a candidate to
+// be within distance k.
+type permutation struct {
+	rot   uint64
+	m2    uint64
+	shift uint64
+	mask  uint64
+}
+
+func (p permutation) shuffle(sig uint64) uint64 {
+	sig = (sig << p.rot) | (sig >> (64 - p.rot))
+	m3 := p.m2 >> p.shift
+	m1 := ^uint64(0) &^ (p.m2 | m3)
+	return (sig & m1) | (sig & p.m2 >> p.shift) | (sig & m3 << p.shift)
+}
+
+func (p permutation) unshuffle(sig uint64) uint64 {
+	m3 := p.m2 >> p.shift
+	m1 := ^uint64(0) &^ (p.m2 | m3)
+	sig = (sig & m1) | (sig & p.m2 >> p.shift) | (sig & m3 << p.shift)
+	return (sig >> p.rot) | (sig << (64 - p.rot))
+}
+
+// splitBits divides n bits into b blocks whose sizes differ by at most one.
+// If largeFirst is set the larger blocks come first, otherwise last.
+func splitBits(n, b int, largeFirst bool) []int {
+	sizes := make([]int, b)
+	small, extra := n/b, n%b
+	for i := range sizes {
+		sizes[i] = small
+		if (largeFirst && i < extra) || (!largeFirst && i >= b-extra) {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+// layout describes one permuted table of an n-bit signature: the top-level
+// block is rotated to the front, and the sub-block starting shift bits after
+// it is swapped up behind it.  The first prefix bits must match exactly.
+type layout struct {
+	rot    int
+	sub    int
+	shift  int
+	prefix int
+}
+
+// layouts computes the tables for searching hamming distance k among n-bit
+// signatures.  The signature is split into k+1 blocks, at least one of which
+// must match exactly.  The remaining bits are again split into k+1
+// sub-blocks, at least one of which must also match exactly, giving
+// (k+1)*(k+1) tables.
+func layouts(k, n int) []layout {
+	var l []layout
+
+	var rot int
+	for _, bsize := range splitBits(n, k+1, false) {
+		var offs int
+		for _, ssize := range splitBits(n-bsize, k+1, true) {
+			l = append(l, layout{rot: rot, sub: ssize, shift: offs, prefix: bsize + ssize})
+			offs += ssize
+		}
+		rot += bsize
+	}
+
+	return l
+}
+
+// permutations computes the 64-bit tables for searching hamming distance k.
+func permutations(k int) []permutation {
+	var perms []permutation
+
+	for _, l := range layouts(k, 64) {
+		perms = append(perms, permutation{
+			rot:   uint64(l.rot),
+			m2:    ((1 << uint(l.sub)) - 1) << uint(64-l.prefix),
+			shift: uint64(l.shift),
+			mask:  ^uint64(0) << uint(64-l.prefix),
+		})
+	}
+
+	return perms
+}
+
+// NewK returns a Store for searching hamming distance <= k.  The block split
+// and table permutations are computed from k; it uses (k+1)*(k+1) tables.
+func NewK(k int, hashes int, newStore func(hashes int) u64store) *Store {
+	if k < 1 || k > 31 {
+		panic(fmt.Sprintf("simstore: unsupported distance k=%d", k))
+	}
+
+	s := Store{k: k, perms: permutations(k)}
+	s.rhashes = make([]u64store, len(s.perms))
+
+	if hashes != 0 {
+		s.docids = make(table, 0, hashes)
+		for i := range s.rhashes {
+			s.rhashes[i] = newStore(hashes)
+		}
+	}
+
+	return &s
+}
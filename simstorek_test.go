@@ -0,0 +1,192 @@
+package simstore
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+func TestUnshuffleK(t *testing.T) {
+
+	for _, k := range []int{1, 2, 3, 4, 5, 6, 8} {
+		f := func(hash uint64) bool {
+			s := NewK(k, 1, NewU64Slice)
+			s.Add(hash, 0)
+
+			for i := range s.rhashes {
+				if got := s.unshuffle((*s.rhashes[i].(*u64slice))[0], i); got != hash {
+					t.Errorf("k=%d: unshuffle(rhashes[%d])=%016x, want %016x\n", k, i, got, hash)
+					return false
+				}
+			}
+			return true
+		}
+
+		quick.Check(f, nil)
+	}
+}
+
+// shuffle3 is the hard-coded table layout of the original New3
+func shuffle3(sig uint64) []uint64 {
+	var ps []uint64
+	for i := 0; i < 4; i++ {
+		ps = append(ps,
+			sig,
+			(sig&0xffff000000ffffff)|(sig&0x0000fff000000000>>12)|(sig&0x0000000fff000000<<12),
+			(sig&0xffff000fff000fff)|(sig&0x0000fff000000000>>24)|(sig&0x0000000000fff000<<24),
+			(sig&0xffff000ffffff000)|(sig&0x0000fff000000000>>36)|(sig&0x0000000000000fff<<36),
+		)
+		sig = (sig << 16) | (sig >> (64 - 16))
+	}
+	return ps
+}
+
+// shuffle6 is the hard-coded table layout of the original New6
+func shuffle6(sig uint64) []uint64 {
+	var ps []uint64
+	for i := 0; i < 6; i++ {
+		ps = append(ps,
+			sig,
+			(sig&0xff80007fffffffff)|(sig&0x007f800000000000>>8)|(sig&0x00007f8000000000<<8),
+			(sig&0xff807f807fffffff)|(sig&0x007f800000000000>>16)|(sig&0x0000007f80000000<<16),
+			(sig&0xff807fff807fffff)|(sig&0x007f800000000000>>24)|(sig&0x000000007f800000<<24),
+			(sig&0xff807fffff807fff)|(sig&0x007f800000000000>>32)|(sig&0x00000000007f8000<<32),
+			(sig&0xff807fffffff807f)|(sig&0x007f800000000000>>40)|(sig&0x0000000000007f80<<40),
+			(sig&0xff80ffffffffff80)|(sig&0x007f000000000000>>48)|(sig&0x000000000000007f<<48),
+		)
+		sig = (sig << 9) | (sig >> (64 - 9))
+	}
+	return append(ps,
+		sig,
+		(sig&0xffc0003fffffffff)|(sig&0x003fc00000000000>>8)|(sig&0x00003fc000000000<<8),
+		(sig&0xffc03fc03fffffff)|(sig&0x003fc00000000000>>16)|(sig&0x0000003fc0000000<<16),
+		(sig&0xffc03fffc03fffff)|(sig&0x003fc00000000000>>24)|(sig&0x000000003fc00000<<24),
+		(sig&0xffc03fffffc03fff)|(sig&0x003fc00000000000>>32)|(sig&0x00000000003fc000<<32),
+		(sig&0xffc07fffffffc07f)|(sig&0x003f800000000000>>40)|(sig&0x0000000000003f80<<40),
+		(sig&0xffc07fffffffff80)|(sig&0x003f800000000000>>47)|(sig&0x000000000000007f<<47),
+	)
+}
+
+// The generated tables for k=3 and k=6 must be exactly those of the original
+// hard-coded New3 and New6
+func TestPermutationsK(t *testing.T) {
+
+	f := func(hash uint64) bool {
+		for _, tt := range []struct {
+			k    int
+			want []uint64
+		}{
+			{3, shuffle3(hash)},
+			{6, shuffle6(hash)},
+		} {
+			perms := permutations(tt.k)
+			if len(perms) != len(tt.want) {
+				t.Fatalf("k=%d: len(perms)=%d, want %d", tt.k, len(perms), len(tt.want))
+			}
+			for i, p := range perms {
+				if got := p.shuffle(hash); got != tt.want[i] {
+					t.Errorf("k=%d: perms[%d].shuffle(%016x)=%016x, want %016x\n", tt.k, i, hash, got, tt.want[i])
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	quick.Check(f, nil)
+
+	for i, p := range permutations(3) {
+		if want := uint64(0xfffffff000000000); p.mask != want {
+			t.Errorf("k=3: perms[%d].mask=%016x, want %016x", i, p.mask, want)
+		}
+	}
+
+	for i, p := range permutations(6) {
+		var want uint64
+		switch {
+		case i < 42 && i%7 != 6:
+			want = 0xffff800000000000
+		case i < 42:
+			want = 0xffff000000000000
+		case i%7 < 5:
+			want = 0xffffc00000000000
+		default:
+			want = 0xffff800000000000
+		}
+		if p.mask != want {
+			t.Errorf("k=6: perms[%d].mask=%016x, want %016x", i, p.mask, want)
+		}
+	}
+}
+
+func TestAddK(t *testing.T) {
+	for _, k := range []int{1, 2, 4, 5, 8} {
+		s := NewK(k, size/10, NewU64Slice)
+		testAdd(t, s, size/10, queries/100, k)
+	}
+}
+
+func TestAddKZ(t *testing.T) {
+	s := NewK(4, size/10, NewZStore)
+	testAdd(t, s, size/10, queries/1000, 4)
+}
+
+func TestFindKMatches(t *testing.T) {
+
+	const signatures = 100000
+
+	stores := []*Store{NewK(3, signatures, NewU64Slice), NewK(6, signatures, NewU64Slice)}
+
+	rng := rand.New(rand.NewSource(0))
+
+	var sigs []uint64
+	for i := 0; i < signatures; i++ {
+		sig := uint64(rng.Int63())
+		sigs = append(sigs, sig)
+		for _, s := range stores {
+			s.Add(sig, uint64(i))
+		}
+	}
+
+	for _, s := range stores {
+		s.Finish()
+	}
+
+	for i := 0; i < 100; i++ {
+		q := sigs[rng.Intn(len(sigs))]
+		for j := rng.Intn(8); j > 0; j-- {
+			q ^= 1 << uint(rng.Intn(64))
+		}
+
+		for _, s := range stores {
+			var want []uint64
+			for id, sig := range sigs {
+				if distance(sig, q) <= s.k {
+					want = append(want, uint64(id))
+				}
+			}
+
+			if got := sortedIDs(s.Find(q)); !equalIDs(got, want) {
+				t.Errorf("k=%d: Find(%016x)=%v, want %v", s.k, q, got, want)
+			}
+		}
+	}
+}
+
+func sortedIDs(ids []uint64) []uint64 {
+	sort.Sort(u64slice(ids))
+	return ids
+}
+
+func equalIDs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
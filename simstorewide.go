@@ -0,0 +1,441 @@
+package simstore
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// wide is a signature of up to 256 bits, most significant word first.
+// Narrower signatures use the leading words and leave the rest zero.
+type wide [4]uint64
+
+func (x wide) and(y wide) wide {
+	for i := range x {
+		x[i] &= y[i]
+	}
+	return x
+}
+
+func (x wide) or(y wide) wide {
+	for i := range x {
+		x[i] |= y[i]
+	}
+	return x
+}
+
+func (x wide) andNot(y wide) wide {
+	for i := range x {
+		x[i] &^= y[i]
+	}
+	return x
+}
+
+// shl shifts x left by s bits
+func (x wide) shl(s int) wide {
+	var r wide
+	w, b := s/64, uint(s%64)
+	for i := 0; i+w < len(x); i++ {
+		r[i] = x[i+w] << b
+		if b != 0 && i+w+1 < len(x) {
+			r[i] |= x[i+w+1] >> (64 - b)
+		}
+	}
+	return r
+}
+
+// shr shifts x right by s bits
+func (x wide) shr(s int) wide {
+	var r wide
+	w, b := s/64, uint(s%64)
+	for i := len(x) - 1; i-w >= 0; i-- {
+		r[i] = x[i-w] >> b
+		if b != 0 && i-w-1 >= 0 {
+			r[i] |= x[i-w-1] << (64 - b)
+		}
+	}
+	return r
+}
+
+// rotl rotates the leading n bits of x left by r bits
+func (x wide) rotl(r, n int) wide {
+	return x.shl(r).or(x.shr(n - r)).and(topBits(n))
+}
+
+func (x wide) less(y wide) bool {
+	for i := range x {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return false
+}
+
+func (x wide) distance(y wide) int {
+	var d int
+	for i := range x {
+		d += distance(x[i], y[i])
+	}
+	return d
+}
+
+// topBits returns a value with the leading n bits set
+func topBits(n int) wide {
+	return wide{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)}.shl(256 - n)
+}
+
+// widePerm is a permutation for signatures of n bits
+type widePerm struct {
+	n     int
+	rot   int
+	shift int
+	m2    wide
+	mask  wide
+}
+
+func (p widePerm) swap(sig wide) wide {
+	m3 := p.m2.shr(p.shift)
+	m1 := topBits(p.n).andNot(p.m2.or(m3))
+	return sig.and(m1).or(sig.and(p.m2).shr(p.shift)).or(sig.and(m3).shl(p.shift))
+}
+
+func (p widePerm) shuffle(sig wide) wide {
+	return p.swap(sig.rotl(p.rot, p.n))
+}
+
+func (p widePerm) unshuffle(sig wide) wide {
+	return p.swap(sig).rotl(p.n-p.rot, p.n)
+}
+
+// widePermutations computes the tables for searching hamming distance k among
+// n-bit signatures, as permutations does for 64 bits
+func widePermutations(k, n int) []widePerm {
+	var perms []widePerm
+
+	for _, l := range layouts(k, n) {
+		perms = append(perms, widePerm{
+			n:     n,
+			rot:   l.rot,
+			shift: l.shift,
+			m2:    topBits(l.prefix).andNot(topBits(l.prefix - l.sub)),
+			mask:  topBits(l.prefix),
+		})
+	}
+
+	return perms
+}
+
+// wideSlice is a table of w-word signatures stored contiguously
+type wideSlice struct {
+	w int
+	v []uint64
+}
+
+func (u *wideSlice) Len() int           { return len(u.v) / u.w }
+func (u *wideSlice) Less(i, j int) bool { return u.at(i).less(u.at(j)) }
+func (u *wideSlice) Swap(i, j int) {
+	a, b := u.v[i*u.w:(i+1)*u.w], u.v[j*u.w:(j+1)*u.w]
+	for k := range a {
+		a[k], b[k] = b[k], a[k]
+	}
+}
+
+func (u *wideSlice) at(i int) wide {
+	var x wide
+	copy(x[:], u.v[i*u.w:(i+1)*u.w])
+	return x
+}
+
+func (u *wideSlice) add(x wide) {
+	u.v = append(u.v, x[:u.w]...)
+}
+
+func (u *wideSlice) find(sig, mask wide, d int) []wide {
+
+	prefix := sig.and(mask)
+	n := u.Len()
+	i := sort.Search(n, func(i int) bool { return !u.at(i).less(prefix) })
+
+	var ids []wide
+
+	for ; i < n; i++ {
+		p := u.at(i)
+		if p.and(mask) != prefix {
+			break
+		}
+		if p.distance(sig) <= d {
+			ids = append(ids, p)
+		}
+	}
+
+	return ids
+}
+
+// wideTable maps wide signatures to document ids
+type wideTable struct {
+	sigs   wideSlice
+	docids []uint64
+}
+
+func (t *wideTable) Len() int           { return len(t.docids) }
+func (t *wideTable) Less(i, j int) bool { return t.sigs.Less(i, j) }
+func (t *wideTable) Swap(i, j int) {
+	t.sigs.Swap(i, j)
+	t.docids[i], t.docids[j] = t.docids[j], t.docids[i]
+}
+
+func (t *wideTable) find(sig wide) []uint64 {
+
+	i := sort.Search(len(t.docids), func(i int) bool { return !t.sigs.at(i).less(sig) })
+
+	var ids []uint64
+
+	for i < len(t.docids) && t.sigs.at(i) == sig {
+		ids = append(ids, t.docids[i])
+		i++
+	}
+
+	return ids
+}
+
+// wideStore is the storage engine behind Store128 and Store256.  The tables
+// are kept as uncompressed sorted arrays, and all signatures must be added
+// before Finish() is called.
+type wideStore struct {
+	k      int
+	perms  []widePerm
+	docids wideTable
+	tables []wideSlice
+}
+
+func newWideStore(k, n, hashes int) wideStore {
+	if k < 1 || 2*(k+1) > n {
+		panic(fmt.Sprintf("simstore: unsupported distance k=%d for %d-bit signatures", k, n))
+	}
+
+	s := wideStore{
+		k:      k,
+		perms:  widePermutations(k, n),
+		docids: wideTable{sigs: wideSlice{w: n / 64, v: make([]uint64, 0, hashes*n/64)}, docids: make([]uint64, 0, hashes)},
+	}
+
+	s.tables = make([]wideSlice, len(s.perms))
+	for i := range s.tables {
+		s.tables[i] = wideSlice{w: n / 64, v: make([]uint64, 0, hashes*n/64)}
+	}
+
+	return s
+}
+
+func (s *wideStore) add(sig wide, docid uint64) {
+	s.docids.sigs.add(sig)
+	s.docids.docids = append(s.docids.docids, docid)
+
+	for t, p := range s.perms {
+		s.tables[t].add(p.shuffle(sig))
+	}
+}
+
+func (s *wideStore) finish() {
+
+	l := make(limiter, runtime.GOMAXPROCS(0))
+
+	var wg sync.WaitGroup
+
+	sort.Sort(&s.docids)
+
+	for i := range s.tables {
+		l.enter()
+		wg.Add(1)
+		go func(i int) {
+			sort.Sort(&s.tables[i])
+			l.leave()
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+// candidates returns the distinct stored signatures within distance d of sig
+func (s *wideStore) candidates(sig wide, d int) []wide {
+	if d > s.k {
+		d = s.k
+	}
+
+	uniq := make(map[wide]struct{})
+
+	for t, p := range s.perms {
+		for _, v := range s.tables[t].find(p.shuffle(sig), p.mask, d) {
+			uniq[p.unshuffle(v)] = struct{}{}
+		}
+	}
+
+	sigs := make([]wide, 0, len(uniq))
+	for v := range uniq {
+		sigs = append(sigs, v)
+	}
+
+	return sigs
+}
+
+func (s *wideStore) find(sig wide, d int) []uint64 {
+	var docids []uint64
+	for _, v := range s.candidates(sig, d) {
+		docids = append(docids, s.docids.find(v)...)
+	}
+
+	return docids
+}
+
+// wideMatch is a match for a wide signature, converted by the callers to
+// Match128 or Match256
+type wideMatch struct {
+	docid    uint64
+	sig      wide
+	distance int
+}
+
+// wideMatches sorts by distance and then document id
+type wideMatches []wideMatch
+
+func (m wideMatches) Len() int      { return len(m) }
+func (m wideMatches) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m wideMatches) Less(i, j int) bool {
+	if m[i].distance != m[j].distance {
+		return m[i].distance < m[j].distance
+	}
+	if m[i].docid != m[j].docid {
+		return m[i].docid < m[j].docid
+	}
+	return m[i].sig.less(m[j].sig)
+}
+
+func (s *wideStore) findMatches(sig wide, d int) []wideMatch {
+	var m []wideMatch
+	for _, v := range s.candidates(sig, d) {
+		d := v.distance(sig)
+		for _, id := range s.docids.find(v) {
+			m = append(m, wideMatch{docid: id, sig: v, distance: d})
+		}
+	}
+
+	sort.Sort(wideMatches(m))
+	return m
+}
+
+// Store128 is a store for 128-bit signatures.  The tables are computed from
+// the hamming distance k as for NewK.
+type Store128 struct {
+	s wideStore
+}
+
+// Match128 is a document found by Store128.FindMatches
+type Match128 struct {
+	DocID    uint64
+	Sig      [2]uint64
+	Distance int
+}
+
+// New128 returns a store for searching 128-bit signatures within hamming
+// distance k.  It uses (k+1)*(k+1) tables.  All signatures must be added
+// before Finish() is called.
+func New128(k int, hashes int) *Store128 {
+	return &Store128{s: newWideStore(k, 128, hashes)}
+}
+
+// Add inserts a signature and document id into the store
+func (s *Store128) Add(sig [2]uint64, docid uint64) {
+	s.s.add(wide{sig[0], sig[1]}, docid)
+}
+
+// Finish prepares the store for searching
+func (s *Store128) Finish() {
+	s.s.finish()
+}
+
+// Find searches the store for all signatures hamming distance k or less from
+// the query signature.  It returns the associated list of document ids.
+func (s *Store128) Find(sig [2]uint64) []uint64 {
+	return s.s.find(wide{sig[0], sig[1]}, s.s.k)
+}
+
+// FindWithin is like Find but only returns documents within distance d of the
+// query signature.  A d greater than k is treated as k.
+func (s *Store128) FindWithin(sig [2]uint64, d int) []uint64 {
+	return s.s.find(wide{sig[0], sig[1]}, d)
+}
+
+// FindMatches is like Find but returns the signature and distance of each
+// match as well, sorted by distance and then document id.
+func (s *Store128) FindMatches(sig [2]uint64) []Match128 {
+	return s.FindMatchesWithin(sig, s.s.k)
+}
+
+// FindMatchesWithin is like FindMatches but only returns documents within
+// distance d of the query signature.  A d greater than k is treated as k.
+func (s *Store128) FindMatchesWithin(sig [2]uint64, d int) []Match128 {
+	var m []Match128
+	for _, v := range s.s.findMatches(wide{sig[0], sig[1]}, d) {
+		m = append(m, Match128{DocID: v.docid, Sig: [2]uint64{v.sig[0], v.sig[1]}, Distance: v.distance})
+	}
+	return m
+}
+
+// Store256 is a store for 256-bit signatures.  The tables are computed from
+// the hamming distance k as for NewK.
+type Store256 struct {
+	s wideStore
+}
+
+// Match256 is a document found by Store256.FindMatches
+type Match256 struct {
+	DocID    uint64
+	Sig      [4]uint64
+	Distance int
+}
+
+// New256 returns a store for searching 256-bit signatures within hamming
+// distance k.  It uses (k+1)*(k+1) tables.  All signatures must be added
+// before Finish() is called.
+func New256(k int, hashes int) *Store256 {
+	return &Store256{s: newWideStore(k, 256, hashes)}
+}
+
+// Add inserts a signature and document id into the store
+func (s *Store256) Add(sig [4]uint64, docid uint64) {
+	s.s.add(wide(sig), docid)
+}
+
+// Finish prepares the store for searching
+func (s *Store256) Finish() {
+	s.s.finish()
+}
+
+// Find searches the store for all signatures hamming distance k or less from
+// the query signature.  It returns the associated list of document ids.
+func (s *Store256) Find(sig [4]uint64) []uint64 {
+	return s.s.find(wide(sig), s.s.k)
+}
+
+// FindWithin is like Find but only returns documents within distance d of the
+// query signature.  A d greater than k is treated as k.
+func (s *Store256) FindWithin(sig [4]uint64, d int) []uint64 {
+	return s.s.find(wide(sig), d)
+}
+
+// FindMatches is like Find but returns the signature and distance of each
+// match as well, sorted by distance and then document id.
+func (s *Store256) FindMatches(sig [4]uint64) []Match256 {
+	return s.FindMatchesWithin(sig, s.s.k)
+}
+
+// FindMatchesWithin is like FindMatches but only returns documents within
+// distance d of the query signature.  A d greater than k is treated as k.
+func (s *Store256) FindMatchesWithin(sig [4]uint64, d int) []Match256 {
+	var m []Match256
+	for _, v := range s.s.findMatches(wide(sig), d) {
+		m = append(m, Match256{DocID: v.docid, Sig: [4]uint64(v.sig), Distance: v.distance})
+	}
+	return m
+}
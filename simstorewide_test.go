@@ -0,0 +1,120 @@
+package simstore
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+// The wide permutations over 64 bits must be exactly those of permutations
+func TestWidePermutations(t *testing.T) {
+
+	for _, k := range []int{1, 3, 6} {
+		perms := permutations(k)
+		wperms := widePermutations(k, 64)
+
+		f := func(hash uint64) bool {
+			for i, p := range perms {
+				got := wperms[i].shuffle(wide{hash})
+				if want := p.shuffle(hash); got != (wide{want}) {
+					t.Errorf("k=%d: shuffle[%d]=%016x, want %016x", k, i, got, want)
+					return false
+				}
+				if back := wperms[i].unshuffle(got); back != (wide{hash}) {
+					t.Errorf("k=%d: unshuffle[%d]=%016x, want %016x", k, i, back, hash)
+					return false
+				}
+			}
+			return true
+		}
+
+		quick.Check(f, nil)
+	}
+}
+
+func TestUnshuffleWide(t *testing.T) {
+
+	for _, n := range []int{128, 256} {
+		for _, k := range []int{1, 5, 12} {
+			f := func(a, b, c, d uint64) bool {
+				sig := wide{a, b, c, d}.and(topBits(n))
+				for i, p := range widePermutations(k, n) {
+					if got := p.unshuffle(p.shuffle(sig)); got != sig {
+						t.Errorf("n=%d k=%d: unshuffle(shuffle[%d](%016x))=%016x", n, k, i, sig, got)
+						return false
+					}
+				}
+				return true
+			}
+
+			quick.Check(f, nil)
+		}
+	}
+}
+
+func TestFindWide(t *testing.T) {
+
+	const signatures = 5000
+
+	rng := rand.New(rand.NewSource(0))
+
+	s128 := New128(8, signatures)
+	s256 := New256(12, signatures)
+
+	var sigs []wide
+	for i := 0; i < signatures; i++ {
+		sig := wide{uint64(rng.Int63()), uint64(rng.Int63()), uint64(rng.Int63()), uint64(rng.Int63())}
+		sigs = append(sigs, sig)
+		s128.Add([2]uint64{sig[0], sig[1]}, uint64(i))
+		s256.Add([4]uint64(sig), uint64(i))
+	}
+
+	s128.Finish()
+	s256.Finish()
+
+	for i := 0; i < 500; i++ {
+		q := sigs[rng.Intn(len(sigs))]
+		for j := rng.Intn(16); j > 0; j-- {
+			q[rng.Intn(4)] ^= 1 << uint(rng.Intn(64))
+		}
+
+		q128 := q.and(topBits(128))
+
+		var want128, want256 []uint64
+		for j, sig := range sigs {
+			if sig.and(topBits(128)).distance(q128) <= 8 {
+				want128 = append(want128, uint64(j))
+			}
+			if sig.distance(q) <= 12 {
+				want256 = append(want256, uint64(j))
+			}
+		}
+
+		if got := sortedIDs(s128.Find([2]uint64{q[0], q[1]})); !equalIDs(got, want128) {
+			t.Errorf("Store128.Find(%016x)=%v, want %v", q128, got, want128)
+		}
+
+		if got := sortedIDs(s256.Find([4]uint64(q))); !equalIDs(got, want256) {
+			t.Errorf("Store256.Find(%016x)=%v, want %v", q, got, want256)
+		}
+
+		for _, m := range s256.FindMatchesWithin([4]uint64(q), 5) {
+			if m.Distance > 5 {
+				t.Errorf("Store256.FindMatchesWithin(%016x, 5) found distance %d", q, m.Distance)
+			}
+		}
+
+		m := s128.FindMatches([2]uint64{q[0], q[1]})
+		if len(m) != len(want128) {
+			t.Errorf("Store128.FindMatches(%016x) found %d, want %d", q128, len(m), len(want128))
+		}
+		for j := range m {
+			if d := (wide{m[j].Sig[0], m[j].Sig[1]}).distance(q128); d != m[j].Distance {
+				t.Errorf("Store128.FindMatches: distance %d, want %d", m[j].Distance, d)
+			}
+			if j > 0 && m[j].Distance < m[j-1].Distance {
+				t.Errorf("Store128.FindMatches: not sorted by distance")
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package vptree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+/*
+The on-disk format is a little-endian stream of 8-byte words holding the node
+and item arrays of the tree:
+
+    header:  "vptree\x00\x00" version:u64 nodes:u64 items:u64
+    nodes:   (sig:u64 id:u64 far|threshold<<32:u64 lo|hi<<32:u64)*nodes
+    items:   (sig:u64 id:u64)*items
+    footer:  crc32c:u64 of everything before it
+*/
+
+const (
+	fileMagic   = "vptree\x00\x00"
+	fileVersion = 1
+)
+
+var (
+	ErrInvalidFormat      = errors.New("vptree: invalid file format")
+	ErrUnsupportedVersion = errors.New("vptree: unsupported file version")
+	ErrChecksum           = errors.New("vptree: checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteTo writes the tree to w
+func (vp *VPTree) WriteTo(w io.Writer) (int64, error) {
+	nodes, items := vp.nodes, vp.items
+	if len(nodes) == 0 {
+		nodes = []node{{}}
+	}
+
+	crc := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	var n int64
+	var buf [32]byte
+
+	write := func(p []byte) error {
+		m, err := bw.Write(p)
+		n += int64(m)
+		return err
+	}
+
+	copy(buf[:], fileMagic)
+	binary.LittleEndian.PutUint64(buf[8:], fileVersion)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(len(nodes)))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(len(items)))
+	if err := write(buf[:]); err != nil {
+		return n, err
+	}
+
+	for _, nd := range nodes {
+		binary.LittleEndian.PutUint64(buf[0:], nd.Item.Sig)
+		binary.LittleEndian.PutUint64(buf[8:], nd.Item.ID)
+		binary.LittleEndian.PutUint64(buf[16:], uint64(nd.far)|uint64(nd.threshold)<<32)
+		binary.LittleEndian.PutUint64(buf[24:], uint64(nd.lo)|uint64(nd.hi)<<32)
+		if err := write(buf[:]); err != nil {
+			return n, err
+		}
+	}
+
+	for _, it := range items {
+		binary.LittleEndian.PutUint64(buf[0:], it.Sig)
+		binary.LittleEndian.PutUint64(buf[8:], it.ID)
+		if err := write(buf[:16]); err != nil {
+			return n, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+
+	binary.LittleEndian.PutUint64(buf[:8], uint64(crc.Sum32()))
+	m, err := w.Write(buf[:8])
+	return n + int64(m), err
+}
+
+// maxPrealloc limits how many entries a (possibly corrupt) count can allocate up front
+const maxPrealloc = 1 << 20
+
+func prealloc(count uint64) int {
+	if count > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(count)
+}
+
+// Read reads a tree written by WriteTo
+func Read(r io.Reader) (*VPTree, error) {
+	crc := crc32.New(crcTable)
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, crc)
+
+	var buf [32]byte
+
+	if _, err := io.ReadFull(tr, buf[:16]); err != nil {
+		return nil, unexpected(err)
+	}
+	if string(buf[:8]) != fileMagic {
+		return nil, ErrInvalidFormat
+	}
+
+	if binary.LittleEndian.Uint64(buf[8:]) != fileVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	vp, err := readTree(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := crc.Sum32()
+	if _, err := io.ReadFull(br, buf[:8]); err != nil {
+		return nil, unexpected(err)
+	}
+	if binary.LittleEndian.Uint64(buf[:8]) != uint64(sum) {
+		return nil, ErrChecksum
+	}
+
+	if err := vp.validate(); err != nil {
+		return nil, err
+	}
+
+	return vp, nil
+}
+
+// readTree reads the node and item arrays following the file header
+func readTree(r io.Reader) (*VPTree, error) {
+	var buf [32]byte
+
+	if _, err := io.ReadFull(r, buf[:16]); err != nil {
+		return nil, unexpected(err)
+	}
+
+	nodeCount := binary.LittleEndian.Uint64(buf[0:])
+	itemCount := binary.LittleEndian.Uint64(buf[8:])
+	if nodeCount > math.MaxUint32 || itemCount > math.MaxUint32 {
+		return nil, ErrInvalidFormat
+	}
+
+	vp := &VPTree{
+		nodes: make([]node, 0, prealloc(nodeCount)),
+		items: make([]Item, 0, prealloc(itemCount)),
+	}
+
+	for i := uint64(0); i < nodeCount; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		far := binary.LittleEndian.Uint64(buf[16:])
+		bucket := binary.LittleEndian.Uint64(buf[24:])
+		if far>>32 > math.MaxUint8 {
+			return nil, ErrInvalidFormat
+		}
+		vp.nodes = append(vp.nodes, node{
+			Item:      Item{Sig: binary.LittleEndian.Uint64(buf[0:]), ID: binary.LittleEndian.Uint64(buf[8:])},
+			far:       uint32(far),
+			threshold: uint8(far >> 32),
+			lo:        uint32(bucket),
+			hi:        uint32(bucket >> 32),
+		})
+	}
+
+	for i := uint64(0); i < itemCount; i++ {
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return nil, unexpected(err)
+		}
+		vp.items = append(vp.items, Item{Sig: binary.LittleEndian.Uint64(buf[0:]), ID: binary.LittleEndian.Uint64(buf[8:])})
+	}
+
+	return vp, nil
+}
+
+// validate checks that the child indices and buckets of every node are in
+// range, so that searching cannot run off the arrays or loop
+func (vp *VPTree) validate() error {
+	if len(vp.nodes) == 0 {
+		return ErrInvalidFormat
+	}
+
+	for i, n := range vp.nodes {
+		if n.far == 0 {
+			if n.lo > n.hi || int(n.hi) > len(vp.items) {
+				return ErrInvalidFormat
+			}
+			continue
+		}
+		if int(n.far) <= i+1 || int(n.far) >= len(vp.nodes) || n.threshold >= maxDistance {
+			return ErrInvalidFormat
+		}
+	}
+
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
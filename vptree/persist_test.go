@@ -0,0 +1,95 @@
+package vptree
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func randomItems(n int) []Item {
+	items := make([]Item, n)
+	for i := range items {
+		items[i] = Item{Sig: uint64(rand.Int63()), ID: uint64(i)}
+	}
+	return items
+}
+
+func TestNewSeeded(t *testing.T) {
+
+	items := randomItems(1000)
+
+	a := NewSeeded(append([]Item(nil), items...), 42)
+	b := NewSeeded(append([]Item(nil), items...), 42)
+	c := NewSeeded(append([]Item(nil), items...), 43)
+
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("NewSeeded: same seed gave different trees")
+	}
+
+	if reflect.DeepEqual(a, c) {
+		t.Errorf("NewSeeded: different seeds gave the same tree")
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+
+	for _, n := range []int{0, 1, 2, 1000} {
+		vp := NewSeeded(randomItems(n), 1)
+
+		var buf bytes.Buffer
+		written, err := vp.WriteTo(&buf)
+		if err != nil || written != int64(buf.Len()) {
+			t.Fatalf("n=%d: WriteTo=%d, %v; wrote %d bytes", n, written, err, buf.Len())
+		}
+
+		got, err := Read(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("n=%d: Read: %v", n, err)
+		}
+
+		if !reflect.DeepEqual(got, vp) {
+			t.Errorf("n=%d: Read gave a different tree", n)
+		}
+
+		for i := 0; i < 10; i++ {
+			q := uint64(rand.Int63())
+			gotItems, gotDists := got.Search(q, 5)
+			wantItems, wantDists := vp.Search(q, 5)
+			compareCoordDistSets(t, gotItems, wantItems, gotDists, wantDists)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+
+	var buf bytes.Buffer
+	NewSeeded(randomItems(100), 1).WriteTo(&buf)
+	data := buf.Bytes()
+
+	corrupt := func(i int) []byte {
+		b := append([]byte(nil), data...)
+		b[i] ^= 0x01
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"magic", corrupt(0), ErrInvalidFormat},
+		{"version", corrupt(8), ErrUnsupportedVersion},
+		{"truncated", data[:len(data)-10], io.ErrUnexpectedEOF},
+		{"no footer", data[:len(data)-8], io.ErrUnexpectedEOF},
+		{"payload", corrupt(100), ErrChecksum},
+	}
+
+	for _, tt := range tests {
+		if _, err := Read(bytes.NewReader(tt.data)); err != tt.want {
+			t.Errorf("%s: Read err=%v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -4,24 +4,36 @@ import (
 	"container/heap"
 	"math"
 	"math/rand"
+	"runtime"
+	"sort"
 
 	"github.com/dgryski/go-simstore/simhash"
 )
 
 type Item struct {
-	Sig  uint64
-	ID uint64
+	Sig uint64
+	ID  uint64
 }
 
 func hamming(a, b uint64) float64 { return float64(simhash.Distance(a, b)) }
 
+// node is an entry in the flattened tree.  An interior node holds a vantage
+// point and the distance splitting its children: the near child directly
+// follows it in the array, and the far child is at index far.  A leaf has
+// far == 0 and holds the bucket items[lo:hi].
 type node struct {
 	Item      Item
-	Threshold float64
-	Left      *node
-	Right     *node
+	far       uint32
+	lo, hi    uint32
+	threshold uint8
 }
 
+// bucketSize is the largest number of items kept in a leaf
+const bucketSize = 16
+
+// maxDistance is larger than the hamming distance between any two signatures
+const maxDistance = 65
+
 type heapItem struct {
 	Item Item
 	Dist float64
@@ -29,31 +41,69 @@ type heapItem struct {
 
 // A VPTree struct represents a Vantage-point tree. Vantage-point trees are
 // useful for nearest-neighbour searches in high-dimensional metric spaces.
+// The tree is stored in two arrays without pointers, so it can hold hundreds
+// of millions of items cheaply.
 type VPTree struct {
-	root *node
+	nodes []node
+	items []Item
 }
 
 // New creates a new VP-tree using the metric and items provided. The metric
 // measures the distance between two items, so that the VP-tree can find the
-// nearest neighbour(s) of a target item.
+// nearest neighbour(s) of a target item.  The vantage points are chosen at
+// random, so each build gives a different tree.  New reorders items but does
+// not keep a reference to it.
 func New(items []Item) (t *VPTree) {
-	t = &VPTree{}
-	t.root = t.buildFromPoints(items)
+	return NewSeeded(items, rand.Int63())
+}
+
+// NewSeeded is like New but chooses the vantage points using seed, so that
+// building from the same items in the same order always gives the same tree.
+// Large subtrees are built in parallel, up to GOMAXPROCS at a time, but the
+// tree does not depend on how many run at once.
+func NewSeeded(items []Item, seed int64) (t *VPTree) {
+	if uint64(len(items)) > math.MaxUint32 {
+		panic("vptree: too many items")
+	}
+
+	l := make(limiter, runtime.GOMAXPROCS(0))
+
+	t = newTree(len(items))
+	l.enter()
+	t.buildFromPoints(items, make([]uint8, len(items)), rand.New(rand.NewSource(seed)), l)
+	l.leave()
 	return
 }
 
+func newTree(size int) *VPTree {
+	return &VPTree{
+		nodes: make([]node, 0, size/itemsPerNode+1),
+		items: make([]Item, 0, size),
+	}
+}
+
 // Search searches the VP-tree for the k nearest neighbours of target. It
 // returns the up to k narest neighbours and the corresponding distances in
 // order of least distance to largest distance.
 func (vp *VPTree) Search(target uint64, k int) (results []Item, distances []float64) {
-	if k < 1 {
+	return vp.SearchBounded(target, k, maxDistance-1)
+}
+
+// SearchBounded is like Search but only returns neighbours within distance
+// maxDist of target.  The search prunes with the bound from the start, so it
+// is faster than Search when the bound is tight.
+func (vp *VPTree) SearchBounded(target uint64, k int, maxDist int) (results []Item, distances []float64) {
+	if k < 1 || maxDist < 0 || len(vp.nodes) == 0 {
 		return
 	}
 
 	h := make(priorityQueue, 0, k)
 
-	tau := math.MaxFloat64
-	vp.search(vp.root, &tau, target, k, &h)
+	tau := maxDistance
+	if maxDist < maxDistance {
+		tau = maxDist + 1
+	}
+	vp.search(0, &tau, target, k, &h)
 
 	for h.Len() > 0 {
 		hi := heap.Pop(&h)
@@ -71,79 +121,264 @@ func (vp *VPTree) Search(target uint64, k int) (results []Item, distances []floa
 	return
 }
 
-func (vp *VPTree) buildFromPoints(items []Item) (n *node) {
-	if len(items) == 0 {
-		return nil
+// SearchRadius searches the VP-tree for all items within distance r of target.
+// It returns them and the corresponding distances in order of least distance
+// to largest distance, and then by ID.
+func (vp *VPTree) SearchRadius(target uint64, r int) (results []Item, distances []float64) {
+	if r < 0 || len(vp.nodes) == 0 {
+		return
 	}
 
-	n = &node{}
-
-	// Take a random item out of the items slice and make it this node's item
-	idx := rand.Intn(len(items))
-	n.Item = items[idx]
-	items[idx], items = items[len(items)-1], items[:len(items)-1]
+	var hits []heapItem
+	vp.searchRadius(0, r, target, &hits)
 
-	if len(items) > 0 {
-		// Now partition the items into two equal-sized sets, one
-		// closer to the node's item than the median, and one farther
-		// away.
-		median := len(items) / 2
-		pivotDist := hamming(items[median].Sig, n.Item.Sig)
-		items[median], items[len(items)-1] = items[len(items)-1], items[median]
-
-		storeIndex := 0
-		for i := 0; i < len(items)-1; i++ {
-			if hamming(items[i].Sig, n.Item.Sig) <= pivotDist {
-				items[storeIndex], items[i] = items[i], items[storeIndex]
-				storeIndex++
-			}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Dist != hits[j].Dist {
+			return hits[i].Dist < hits[j].Dist
 		}
-		items[len(items)-1], items[storeIndex] = items[storeIndex], items[len(items)-1]
-		median = storeIndex
+		return hits[i].Item.ID < hits[j].Item.ID
+	})
 
-		n.Threshold = hamming(items[median].Sig, n.Item.Sig)
-		n.Left = vp.buildFromPoints(items[:median])
-		n.Right = vp.buildFromPoints(items[median:])
+	for _, h := range hits {
+		results = append(results, h.Item)
+		distances = append(distances, h.Dist)
 	}
+
 	return
 }
 
-func (vp *VPTree) search(n *node, tau *float64, target uint64, k int, h *priorityQueue) {
-	if n == nil {
+type limiter chan struct{}
+
+func (l limiter) enter() { l <- struct{}{} }
+func (l limiter) leave() { <-l }
+
+const (
+	// itemsPerNode estimates the number of items for each node, so the node
+	// array can be allocated up front
+	itemsPerNode = 6
+
+	// parallelSize is the smallest subtree built in a goroutine of its own
+	parallelSize = 1 << 16
+
+	// sampleSize is the smallest subtree whose vantage point is chosen by
+	// sampling sampleCandidates candidates, each compared with sampleItems
+	// random items
+	sampleSize       = 1024
+	sampleCandidates = 5
+	sampleItems      = 32
+)
+
+// buildFromPoints appends the subtree for items to vp.nodes, and the contents
+// of its leaves to vp.items.  dists is scratch space as long as items.  The
+// caller must hold a slot in l, which is released while waiting for subtrees
+// built by other goroutines.
+func (vp *VPTree) buildFromPoints(items []Item, dists []uint8, rng *rand.Rand, l limiter) {
+	if len(items) <= bucketSize {
+		lo := len(vp.items)
+		vp.items = append(vp.items, items...)
+		vp.nodes = append(vp.nodes, node{lo: uint32(lo), hi: uint32(len(vp.items))})
 		return
 	}
 
-	dist := hamming(n.Item.Sig, target)
+	n := len(vp.nodes)
+	vp.nodes = append(vp.nodes, node{})
+
+	// Take the vantage point out of the items slice and make it this node's item
+	idx := choosePivot(items, rng)
+	vantage := items[idx]
+	items[idx], items = items[len(items)-1], items[:len(items)-1]
+	dists = dists[:len(items)]
+
+	median, threshold := partition(items, dists, vantage.Sig)
+
+	if len(items) < parallelSize {
+		vp.buildFromPoints(items[:median], dists[:median], rng, l)
+		far := len(vp.nodes)
+		vp.buildFromPoints(items[median:], dists[median:], rng, l)
+		vp.nodes[n] = node{Item: vantage, far: uint32(far), threshold: uint8(threshold)}
+		return
+	}
+
+	// Build the far subtree in another goroutine.  Its random source is
+	// seeded here, so that the tree is the same however the goroutines run.
+	sub := newTree(len(items) - median)
+	subRng := rand.New(rand.NewSource(rng.Int63()))
+	done := make(chan struct{})
+	go func() {
+		l.enter()
+		sub.buildFromPoints(items[median:], dists[median:], subRng, l)
+		l.leave()
+		close(done)
+	}()
+
+	vp.buildFromPoints(items[:median], dists[:median], rng, l)
 
-	if dist < *tau {
-		if h.Len() == k {
-			heap.Pop(h)
+	l.leave()
+	<-done
+	l.enter()
+
+	far := len(vp.nodes)
+	vp.graft(sub)
+	vp.nodes[n] = node{Item: vantage, far: uint32(far), threshold: uint8(threshold)}
+}
+
+// choosePivot returns the index of the vantage point for items.  For large
+// sets it samples a few candidates and picks the one whose distances to a
+// sample of the items have the largest spread, which splits the items better
+// than a random choice.
+func choosePivot(items []Item, rng *rand.Rand) int {
+	if len(items) < sampleSize {
+		return rng.Intn(len(items))
+	}
+
+	best, bestSpread := 0, -1
+	for c := 0; c < sampleCandidates; c++ {
+		idx := rng.Intn(len(items))
+
+		var sum, sumSquares int
+		for i := 0; i < sampleItems; i++ {
+			d := simhash.Distance(items[idx].Sig, items[rng.Intn(len(items))].Sig)
+			sum += d
+			sumSquares += d * d
 		}
-		heap.Push(h, &heapItem{n.Item, dist})
-		if h.Len() == k {
-			*tau = h.Top().(*heapItem).Dist
+
+		// sampleItems times the variance of the distances
+		if spread := sumSquares - sum*sum/sampleItems; spread > bestSpread {
+			best, bestSpread = idx, spread
 		}
 	}
 
-	if n.Left == nil && n.Right == nil {
+	return best
+}
+
+// partition reorders items so that the first half are no farther from sig than
+// threshold, and the rest are no nearer.  Items at exactly the threshold are
+// split between the halves so that they are the same size.  dists is scratch
+// space as long as items.
+func partition(items []Item, dists []uint8, sig uint64) (median int, threshold int) {
+	var counts [maxDistance]int
+	for i, it := range items {
+		d := simhash.Distance(it.Sig, sig)
+		dists[i] = uint8(d)
+		counts[d]++
+	}
+
+	median = len(items) / 2
+	for below := 0; below+counts[threshold] <= median && threshold < maxDistance-1; threshold++ {
+		below += counts[threshold]
+	}
+
+	swap := func(i, j int) {
+		items[i], items[j] = items[j], items[i]
+		dists[i], dists[j] = dists[j], dists[i]
+	}
+
+	storeIndex := 0
+	for i := range items {
+		if int(dists[i]) < threshold {
+			swap(storeIndex, i)
+			storeIndex++
+		}
+	}
+	for i := storeIndex; storeIndex < median; i++ {
+		if int(dists[i]) == threshold {
+			swap(storeIndex, i)
+			storeIndex++
+		}
+	}
+
+	return median, threshold
+}
+
+// graft appends the tree sub to vp, so that its root follows the last node
+func (vp *VPTree) graft(sub *VPTree) {
+	nodeBase, itemBase := uint32(len(vp.nodes)), uint32(len(vp.items))
+	for _, n := range sub.nodes {
+		if n.far != 0 {
+			n.far += nodeBase
+		} else {
+			n.lo += itemBase
+			n.hi += itemBase
+		}
+		vp.nodes = append(vp.nodes, n)
+	}
+	vp.items = append(vp.items, sub.items...)
+}
+
+func (vp *VPTree) search(i int, tau *int, target uint64, k int, h *priorityQueue) {
+	n := &vp.nodes[i]
+
+	if n.far == 0 {
+		for _, it := range vp.items[n.lo:n.hi] {
+			visit(it, simhash.Distance(it.Sig, target), tau, k, h)
+		}
 		return
 	}
 
-	if dist < n.Threshold {
-		if dist-*tau <= n.Threshold {
-			vp.search(n.Left, tau, target, k, h)
+	dist := simhash.Distance(n.Item.Sig, target)
+	visit(n.Item, dist, tau, k, h)
+
+	threshold := int(n.threshold)
+
+	if dist < threshold {
+		if dist-*tau <= threshold {
+			vp.search(i+1, tau, target, k, h)
 		}
 
-		if dist+*tau >= n.Threshold {
-			vp.search(n.Right, tau, target, k, h)
+		if dist+*tau >= threshold {
+			vp.search(int(n.far), tau, target, k, h)
 		}
 	} else {
-		if dist+*tau >= n.Threshold {
-			vp.search(n.Right, tau, target, k, h)
+		if dist+*tau >= threshold {
+			vp.search(int(n.far), tau, target, k, h)
 		}
 
-		if dist-*tau <= n.Threshold {
-			vp.search(n.Left, tau, target, k, h)
+		if dist-*tau <= threshold {
+			vp.search(i+1, tau, target, k, h)
 		}
 	}
 }
+
+func (vp *VPTree) searchRadius(i int, r int, target uint64, hits *[]heapItem) {
+	n := &vp.nodes[i]
+
+	if n.far == 0 {
+		for _, it := range vp.items[n.lo:n.hi] {
+			if dist := simhash.Distance(it.Sig, target); dist <= r {
+				*hits = append(*hits, heapItem{it, float64(dist)})
+			}
+		}
+		return
+	}
+
+	dist := simhash.Distance(n.Item.Sig, target)
+	if dist <= r {
+		*hits = append(*hits, heapItem{n.Item, float64(dist)})
+	}
+
+	threshold := int(n.threshold)
+
+	if dist-r <= threshold {
+		vp.searchRadius(i+1, r, target, hits)
+	}
+
+	if dist+r >= threshold {
+		vp.searchRadius(int(n.far), r, target, hits)
+	}
+}
+
+// visit adds it to the k nearest neighbours found so far if it is closer than
+// tau, and shrinks tau once there are k of them
+func visit(it Item, dist int, tau *int, k int, h *priorityQueue) {
+	if dist >= *tau {
+		return
+	}
+
+	if h.Len() == k {
+		heap.Pop(h)
+	}
+	heap.Push(h, &heapItem{it, float64(dist)})
+	if h.Len() == k {
+		*tau = int(h.Top().(*heapItem).Dist)
+	}
+}
@@ -2,6 +2,9 @@ package vptree
 
 import (
 	"container/heap"
+	"math/rand"
+	"reflect"
+	"runtime"
 	"testing"
 )
 
@@ -98,3 +101,194 @@ func TestSmall(t *testing.T) {
 
 	compareCoordDistSets(t, coords1, coords2, distances1, distances2)
 }
+
+// This test searches a tree large enough to have many levels and leaf
+// buckets, comparing the distances found with the brute-force search.  Items
+// at equal distances may be returned in any order.
+func TestSearch(t *testing.T) {
+	items := randomItems(5000)
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 100; i++ {
+		target := uint64(rand.Int63())
+		k := 1 + rand.Intn(20)
+
+		_, distances1 := vp.Search(target, k)
+		_, distances2 := nearestNeighbours(target, items, k)
+
+		if len(distances1) != len(distances2) {
+			t.Fatalf("Search(%x, %d) found %d items, want %d", target, k, len(distances1), len(distances2))
+		}
+		for j := range distances1 {
+			if distances1[j] != distances2[j] {
+				t.Fatalf("Search(%x, %d) distances=%v, want %v", target, k, distances1, distances2)
+			}
+		}
+	}
+}
+
+func TestSearchBounded(t *testing.T) {
+	items := randomItems(5000)
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 100; i++ {
+		target := items[rand.Intn(len(items))].Sig ^ uint64(rand.Int63())&0xffffff
+		k := 1 + rand.Intn(20)
+		maxDist := rand.Intn(24)
+
+		_, distances1 := vp.SearchBounded(target, k, maxDist)
+		_, distances2 := nearestNeighbours(target, items, k)
+
+		for len(distances2) > 0 && distances2[len(distances2)-1] > float64(maxDist) {
+			distances2 = distances2[:len(distances2)-1]
+		}
+
+		if len(distances1) != len(distances2) {
+			t.Fatalf("SearchBounded(%x, %d, %d) found %d items, want %d", target, k, maxDist, len(distances1), len(distances2))
+		}
+		for j := range distances1 {
+			if distances1[j] != distances2[j] {
+				t.Fatalf("SearchBounded(%x, %d, %d) distances=%v, want %v", target, k, maxDist, distances1, distances2)
+			}
+		}
+	}
+
+	if got, _ := vp.SearchBounded(0, 10, -1); len(got) != 0 {
+		t.Errorf("SearchBounded with negative bound found %d items", len(got))
+	}
+}
+
+func TestSearchRadius(t *testing.T) {
+	items := randomItems(5000)
+	vp := New(append([]Item(nil), items...))
+
+	for i := 0; i < 100; i++ {
+		target := items[rand.Intn(len(items))].Sig ^ uint64(rand.Int63())&0xffff
+		r := rand.Intn(24)
+
+		var want []Item
+		for _, it := range items {
+			if hamming(it.Sig, target) <= float64(r) {
+				want = append(want, it)
+			}
+		}
+
+		got, distances := vp.SearchRadius(target, r)
+
+		if len(got) != len(want) {
+			t.Fatalf("SearchRadius(%x, %d) found %d items, want %d", target, r, len(got), len(want))
+		}
+		for j := range got {
+			if d := hamming(got[j].Sig, target); d != distances[j] || d > float64(r) {
+				t.Fatalf("SearchRadius(%x, %d): item %x at distance %v, reported %v", target, r, got[j], d, distances[j])
+			}
+			if j > 0 && (distances[j] < distances[j-1] || distances[j] == distances[j-1] && got[j].ID <= got[j-1].ID) {
+				t.Fatalf("SearchRadius(%x, %d): results not sorted or repeated", target, r)
+			}
+		}
+	}
+
+	if got, _ := vp.SearchRadius(0, -1); len(got) != 0 {
+		t.Errorf("SearchRadius with negative radius found %d items", len(got))
+	}
+}
+
+// This test builds a tree large enough to have subtrees built in parallel, and
+// checks that it doesn't depend on GOMAXPROCS and still searches correctly.
+func TestParallelBuild(t *testing.T) {
+	items := randomItems(4 * parallelSize)
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	serial := NewSeeded(append([]Item(nil), items...), 1)
+	runtime.GOMAXPROCS(4)
+	parallel := NewSeeded(append([]Item(nil), items...), 1)
+
+	if !reflect.DeepEqual(serial, parallel) {
+		t.Fatalf("NewSeeded gave different trees with GOMAXPROCS 1 and 4")
+	}
+
+	for i := 0; i < 10; i++ {
+		target := uint64(rand.Int63())
+
+		_, distances1 := parallel.Search(target, 10)
+		_, distances2 := nearestNeighbours(target, items, 10)
+
+		if !reflect.DeepEqual(distances1, distances2) {
+			t.Fatalf("Search(%x, 10) distances=%v, want %v", target, distances1, distances2)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for _, n := range []int{17, 100, 1001} {
+		items := randomItems(n)
+		sig := uint64(rand.Int63())
+
+		median, threshold := partition(items, make([]uint8, n), sig)
+
+		if median != n/2 {
+			t.Errorf("partition(%d items) median=%d, want %d", n, median, n/2)
+		}
+		for i, it := range items {
+			d := int(hamming(it.Sig, sig))
+			if (i < median && d > threshold) || (i >= median && d < threshold) {
+				t.Fatalf("partition(%d items): item %d at distance %d on the wrong side of %d", n, i, d, threshold)
+			}
+		}
+	}
+}
+
+const benchItems = 1 << 20
+
+func BenchmarkNew(b *testing.B) {
+	items := randomItems(benchItems)
+	work := make([]Item, len(items))
+
+	var before, after runtime.MemStats
+	var vp *VPTree
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(work, items)
+		vp = nil
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		vp = NewSeeded(work, int64(i))
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+	}
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchItems, "heap-bytes/item")
+	runtime.KeepAlive(vp)
+}
+
+func BenchmarkSearch(b *testing.B) {
+	vp := NewSeeded(randomItems(benchItems), 1)
+	queries := benchQueries()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vp.Search(queries[i%len(queries)], 10)
+	}
+}
+
+func BenchmarkSearchBounded(b *testing.B) {
+	vp := NewSeeded(randomItems(benchItems), 1)
+	queries := benchQueries()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vp.SearchBounded(queries[i%len(queries)], 10, 12)
+	}
+}
+
+func benchQueries() []uint64 {
+	queries := make([]uint64, 1024)
+	for i := range queries {
+		queries[i] = uint64(rand.Int63())
+	}
+	return queries
+}
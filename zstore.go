@@ -3,8 +3,10 @@ package simstore
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"sort"
+	"sync"
 
 	"github.com/dgryski/go-bits"
 	"github.com/dgryski/go-bitstream"
@@ -17,10 +19,15 @@ const (
 )
 
 type zstore struct {
-	index []uint64
-	d     *huff.Decoder
-	b     []byte
-	u     u64slice
+	index  []uint64
+	d      *huff.Decoder
+	b      []byte
+	u      u64slice
+	counts [64]int
+
+	// the first corrupt block found, reported by corrupt()
+	mu  sync.Mutex
+	err error
 }
 
 func NewZStore(hashes int) u64store {
@@ -32,18 +39,78 @@ func (z *zstore) add(p uint64) {
 }
 
 func (z *zstore) finish() {
+	// already compressed or loaded from disk
+	if len(z.u) == 0 {
+		return
+	}
 	z.u.finish()
 	z.compress()
 	z.u = nil
 }
 
+// merge returns a new compressed store containing the signatures of z and d,
+// less those in rm
+func (z *zstore) merge(d, rm u64slice) u64store {
+	var u u64slice
+	for i := range z.index {
+		u = append(u, z.block(i)...)
+	}
+
+	m := &zstore{u: *u.merge(d, rm).(*u64slice)}
+	m.finish()
+	m.err = z.corrupt()
+	return m
+}
+
 func (z *zstore) blocks() int {
 	return len(z.index)
 }
 
+// validate checks the structure of a table loaded from a store of docs
+// documents without decompressing it: the blocks must cover the index, the
+// index must be sorted, and the table cannot hold more distinct signatures
+// than there are documents.
+func (z *zstore) validate(docs int) error {
+
+	// the first signature of a table isn't counted
+	sigs := 1
+	for _, c := range z.counts {
+		if c < 0 || c > docs {
+			return ErrInvalidFormat
+		}
+		sigs += c
+	}
+
+	// empty table
+	if len(z.index) == 0 {
+		if len(z.b) != 0 || sigs != 1 {
+			return ErrInvalidFormat
+		}
+		return nil
+	}
+
+	if sigs > docs || len(z.index) > sigs {
+		return ErrInvalidFormat
+	}
+
+	// every block starts with a full signature; only the last may be short
+	last := len(z.b) - (len(z.index)-1)*blockSize
+	if last < 8 || last > blockSize {
+		return ErrInvalidFormat
+	}
+
+	for i := 1; i < len(z.index); i++ {
+		if z.index[i] <= z.index[i-1] {
+			return ErrInvalidFormat
+		}
+	}
+
+	return nil
+}
+
 func (z *zstore) compress() {
 
-	var counts [64]int
+	counts := &z.counts
 
 	for i := 1; i < len(z.u); i++ {
 		lz := bits.Clz(z.u[i] ^ z.u[i-1])
@@ -122,7 +189,31 @@ var (
 	ErrInvalidBlock = errors.New("zstore: invalid block")
 )
 
-func (z zstore) decompressBlock(block int) (u64slice, error) {
+// block returns the signatures in a block.  A block that fails to decompress
+// means the table is corrupt: it is searched as empty, and the error is kept
+// so that the lost signatures are reported by corrupt() rather than dropped
+// silently.
+func (z *zstore) block(block int) u64slice {
+	u, err := z.decompressBlock(block)
+	if err != nil {
+		z.mu.Lock()
+		if z.err == nil {
+			z.err = fmt.Errorf("zstore: block %d: %v", block, err)
+		}
+		z.mu.Unlock()
+		return nil
+	}
+	return u
+}
+
+// corrupt returns the error for the first block that failed to decompress
+func (z *zstore) corrupt() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *zstore) decompressBlock(block int) (u64slice, error) {
 
 	if block < 0 || block >= len(z.index) {
 		return nil, ErrInvalidBlock
@@ -147,6 +238,9 @@ func (z zstore) decompressBlock(block int) (u64slice, error) {
 	prev := sig
 	for {
 		samebits, err := z.d.ReadSymbol(br)
+		if err != nil {
+			return nil, ErrCorruptFile
+		}
 		if samebits == huff.EOF {
 			break
 		}
@@ -168,6 +262,49 @@ func (z zstore) decompressBlock(block int) (u64slice, error) {
 	return u, nil
 }
 
+// findSorted is like u64slice.findSorted.  Consecutive queries usually land
+// in the same blocks, so the last two decompressed blocks are kept.
+func (z *zstore) findSorted(sigs []uint64, mask uint64, d int, found func(i int, p uint64)) {
+
+	var cache [2]struct {
+		block int
+		u     u64slice
+	}
+	cache[0].block, cache[1].block = -1, -1
+
+	get := func(block int) u64slice {
+		for _, c := range cache {
+			if c.block == block {
+				return c.u
+			}
+		}
+		u := z.block(block)
+		cache[0] = cache[1]
+		cache[1].block, cache[1].u = block, u
+		return u
+	}
+
+	var lo int
+	for i, sig := range sigs {
+		prefix := sig & mask
+		lo += sort.Search(len(z.index)-lo, func(j int) bool { return z.index[lo+j] >= prefix })
+
+		block := lo
+		if block > 0 {
+			for _, p := range get(block-1).find(sig, mask, d) {
+				found(i, p)
+			}
+		}
+
+		for block < z.blocks() && z.index[block]&mask == prefix {
+			for _, p := range get(block).find(sig, mask, d) {
+				found(i, p)
+			}
+			block++
+		}
+	}
+}
+
 func (z *zstore) find(sig, mask uint64, d int) []uint64 {
 
 	prefix := sig & mask
@@ -177,15 +314,11 @@ func (z *zstore) find(sig, mask uint64, d int) []uint64 {
 	var ids []uint64
 
 	if block > 0 {
-		if u, err := z.decompressBlock(block - 1); err == nil {
-			ids = append(ids, u.find(sig, mask, d)...)
-		}
+		ids = append(ids, z.block(block-1).find(sig, mask, d)...)
 	}
 
 	for block < z.blocks() && z.index[block]&mask == prefix {
-		if u, err := z.decompressBlock(block); err == nil {
-			ids = append(ids, u.find(sig, mask, d)...)
-		}
+		ids = append(ids, z.block(block).find(sig, mask, d)...)
 		block++
 	}
 	return ids
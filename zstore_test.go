@@ -3,6 +3,7 @@ package simstore
 import (
 	"math/rand"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 	"unsafe"
@@ -108,3 +109,46 @@ func TestDuplicateSignatures(t *testing.T) {
 		}
 	}
 }
+
+func TestCorruptBlock(t *testing.T) {
+
+	var u u64slice
+	for i := 0; i < 5000; i++ {
+		u = append(u, uint64(i)*0x9e3779b97f4a7c15)
+	}
+	sort.Sort(u)
+
+	z := &zstore{u: u}
+	z.finish()
+	// drop the last block and cut the one before it short
+	last := z.blocks() - 2
+	z.index = z.index[:last+1]
+	z.b = z.b[:last*blockSize+12]
+
+	if got := z.find(z.index[last], ^uint64(0), 0); len(got) != 0 {
+		t.Errorf("find in a corrupt block=%x, want nothing", got)
+	}
+
+	if err := z.corrupt(); err == nil || !strings.HasPrefix(err.Error(), "zstore: block") {
+		t.Errorf("corrupt()=%v, want a corrupt block error", err)
+	}
+
+	// the error survives a merge, which loses the block
+	if m := z.merge(nil, nil).(*zstore); m.corrupt() == nil {
+		t.Errorf("merged corrupt()=nil, want the corrupt block error")
+	}
+
+	s := New3(20000, NewZStore)
+	fillStore(t, s, 20000, rand.New(rand.NewSource(0)))
+	s.Finish()
+
+	z = s.rhashes[0].(*zstore)
+	last = z.blocks() - 2
+	z.index = z.index[:last+1]
+	z.b = z.b[:last*blockSize+12]
+
+	s.Find(s.unshuffle(z.index[last], 0))
+	if err := s.Err(); err == nil {
+		t.Errorf("Store.Err()=nil after searching a corrupt block")
+	}
+}